@@ -0,0 +1,559 @@
+package indexes
+
+import (
+	"math/bits"
+	"sort"
+	"sync"
+)
+
+var (
+	// NewSet uses a BitmapSet for sets with at least BitmapThreshold ids which
+	// average at least BitmapDensity ids per block of 65536 ids
+	BitmapThreshold = 1024
+	BitmapDensity   = 64
+)
+
+const (
+	// past this many values, a bitmap container is smaller than an array one
+	arrayMax    = 4096
+	bitmapWords = 65536 / 64
+)
+
+// A compressed (roaring) bitmap. Ids are grouped into containers by their
+// high bits. Each container holds the low 16 bits as a sorted array, a
+// bitmap or a list of runs, whichever is smallest.
+type BitmapSet struct {
+	sync.RWMutex
+	length     int
+	keys       []bitmapKey
+	containers []container
+}
+
+func NewBitmapSet(ids []Id) *BitmapSet {
+	sorted := make([]Id, len(ids))
+	copy(sorted, ids)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	set := new(BitmapSet)
+	values := make([]uint16, 0, arrayMax)
+	for i, l := 0, len(sorted); i < l; {
+		key := bitmapKey(sorted[i] >> 16)
+		values = values[:0]
+		for ; i < l && bitmapKey(sorted[i]>>16) == key; i++ {
+			value := uint16(sorted[i])
+			if n := len(values); n > 0 && values[n-1] == value {
+				continue
+			}
+			values = append(values, value)
+		}
+		set.append(key, newContainer(values))
+	}
+	return set
+}
+
+// whether a set of ids is dense enough to be best stored as a bitmap
+func isDense(ids []Id) bool {
+	l := len(ids)
+	if l == 0 || l < BitmapThreshold {
+		return false
+	}
+	min, max := ids[0], ids[0]
+	for _, id := range ids {
+		if id < min {
+			min = id
+		} else if id > max {
+			max = id
+		}
+	}
+	blocks := int((max-min)>>16) + 1
+	return l/blocks >= BitmapDensity
+}
+
+func (s *BitmapSet) Len() int {
+	return s.length
+}
+
+func (s *BitmapSet) Exists(value Id) bool {
+	i := s.index(bitmapKey(value >> 16))
+	return i != -1 && s.containers[i].contains(uint16(value))
+}
+
+// Unlike the other sets, ids are always yielded in order
+func (s *BitmapSet) Each(desc bool, fn func(Id) bool) {
+	l := len(s.keys)
+	for n := 0; n < l; n++ {
+		i := n
+		if desc {
+			i = l - n - 1
+		}
+		high := Id(s.keys[i]) << 16
+		more := s.containers[i].each(desc, func(value uint16) bool {
+			return fn(high | Id(value))
+		})
+		if more == false {
+			return
+		}
+	}
+}
+
+func (s *BitmapSet) Add(id Id) {
+	key, value := bitmapKey(id>>16), uint16(id)
+	i := s.search(key)
+	if i == len(s.keys) || s.keys[i] != key {
+		s.keys = append(s.keys, 0)
+		copy(s.keys[i+1:], s.keys[i:])
+		s.keys[i] = key
+		s.containers = append(s.containers, nil)
+		copy(s.containers[i+1:], s.containers[i:])
+		s.containers[i] = arrayContainer{value}
+	} else if s.containers[i].contains(value) {
+		return
+	} else {
+		s.containers[i] = s.containers[i].add(value)
+	}
+	s.length++
+}
+
+// A container left empty is dropped along with its key
+func (s *BitmapSet) Remove(id Id) {
+	key, value := bitmapKey(id>>16), uint16(id)
+	i := s.index(key)
+	if i == -1 || s.containers[i].contains(value) == false {
+		return
+	}
+	s.length--
+	c := s.containers[i].remove(value)
+	if c.cardinality() > 0 {
+		s.containers[i] = c
+		return
+	}
+	s.keys = append(s.keys[:i], s.keys[i+1:]...)
+	copy(s.containers[i:], s.containers[i+1:])
+	s.containers[len(s.containers)-1] = nil
+	s.containers = s.containers[:len(s.containers)-1]
+}
+
+func (s *BitmapSet) Around(id Id, fn func(Id) bool) {
+	s.Each(false, fn)
+}
+
+func (s *BitmapSet) CanRank() bool {
+	return false
+}
+
+func (s *BitmapSet) Rank(id Id) (int, bool) {
+	return 0, false
+}
+
+// Returns a new set of the ids which exist in both sets
+func (s *BitmapSet) And(other *BitmapSet) *BitmapSet {
+	set := new(BitmapSet)
+	set.and(s, other)
+	return set
+}
+
+// Replaces the content of s with the intersection of a and b, reusing its
+// buffers. s can be a or b: containers are only ever written at or behind
+// the position being read.
+func (s *BitmapSet) and(a *BitmapSet, b *BitmapSet) {
+	keys, containers, length := s.keys[:0], s.containers[:0], 0
+	for i, j := 0, 0; i < len(a.keys) && j < len(b.keys); {
+		x, y := a.keys[i], b.keys[j]
+		if x < y {
+			i++
+		} else if x > y {
+			j++
+		} else {
+			if c := intersect(a.containers[i], b.containers[j]); c.cardinality() > 0 {
+				keys = append(keys, x)
+				containers = append(containers, c)
+				length += c.cardinality()
+			}
+			i++
+			j++
+		}
+	}
+	for i := len(containers); i < len(s.containers); i++ {
+		s.containers[i] = nil
+	}
+	s.keys, s.containers, s.length = keys, containers, length
+}
+
+// Estimates the work of and(a, b), in set lookups, without doing it: the keys
+// are merged, and only the containers of the keys both have are intersected.
+// An array is intersected by looking up each of its values, anything else a
+// word at a time, once it's been converted to a bitmap.
+func andCost(a *BitmapSet, b *BitmapSet) int {
+	cost := len(a.keys) + len(b.keys)
+	for i, j := 0, 0; i < len(a.keys) && j < len(b.keys); {
+		x, y := a.keys[i], b.keys[j]
+		if x < y {
+			i++
+		} else if x > y {
+			j++
+		} else {
+			cost += intersectCost(a.containers[i], b.containers[j])
+			i++
+			j++
+		}
+	}
+	return cost
+}
+
+// how many words can be ANDed, or bits set, in the time of one set lookup
+const wordsPerLookup = 16
+
+func intersectCost(a container, b container) int {
+	if arr, ok := a.(arrayContainer); ok {
+		return len(arr)
+	}
+	if arr, ok := b.(arrayContainer); ok {
+		return len(arr)
+	}
+	words := bitmapWords
+	for _, c := range []container{a, b} {
+		if _, ok := c.(*bitmapContainer); ok == false {
+			words += c.cardinality()
+		}
+	}
+	return words / wordsPerLookup
+}
+
+func (s *BitmapSet) append(key bitmapKey, c container) {
+	s.keys = append(s.keys, key)
+	s.containers = append(s.containers, c)
+	s.length += c.cardinality()
+}
+
+func (s *BitmapSet) index(key bitmapKey) int {
+	if i := s.search(key); i < len(s.keys) && s.keys[i] == key {
+		return i
+	}
+	return -1
+}
+
+// the position of the first key which isn't less than key
+func (s *BitmapSet) search(key bitmapKey) int {
+	lo, hi := 0, len(s.keys)
+	for lo < hi {
+		m := int(uint(lo+hi) >> 1)
+		if s.keys[m] < key {
+			lo = m + 1
+		} else {
+			hi = m
+		}
+	}
+	return lo
+}
+
+type container interface {
+	cardinality() int
+	contains(value uint16) bool
+	// returns false if fn stopped the iteration
+	each(desc bool, fn func(value uint16) bool) bool
+	// value must not be in the container. The container is changed in place
+	// and the one to use from then on is returned.
+	add(value uint16) container
+	// value must be in the container. Like add, returns the container to use.
+	remove(value uint16) container
+}
+
+// values must be sorted and unique
+func newContainer(values []uint16) container {
+	l := len(values)
+	runs := 1
+	for i := 1; i < l; i++ {
+		if values[i] != values[i-1]+1 {
+			runs++
+		}
+	}
+
+	// sizes, in bytes: array = 2*l, bitmap = 8192, runs = 4*runs
+	if runs*4 < l*2 && runs*4 < bitmapWords*8 {
+		c := make(runContainer, 0, runs)
+		start := values[0]
+		for i := 1; i <= l; i++ {
+			if i == l || values[i] != values[i-1]+1 {
+				c = append(c, interval{start, values[i-1]})
+				if i < l {
+					start = values[i]
+				}
+			}
+		}
+		return c
+	}
+	if l <= arrayMax {
+		c := make(arrayContainer, l)
+		copy(c, values)
+		return c
+	}
+	c := &bitmapContainer{words: make([]uint64, bitmapWords)}
+	for _, value := range values {
+		c.words[value>>6] |= 1 << (value & 63)
+	}
+	c.n = l
+	return c
+}
+
+func intersect(a container, b container) container {
+	if arr, ok := a.(arrayContainer); ok {
+		return arr.filter(b)
+	}
+	if arr, ok := b.(arrayContainer); ok {
+		return arr.filter(a)
+	}
+	x, y := toBitmap(a), toBitmap(b)
+	c := &bitmapContainer{words: make([]uint64, bitmapWords)}
+	for i, word := range x.words {
+		word &= y.words[i]
+		c.words[i] = word
+		c.n += bits.OnesCount64(word)
+	}
+	if c.n > arrayMax {
+		return c
+	}
+	values := make(arrayContainer, 0, c.n)
+	c.each(false, func(value uint16) bool {
+		values = append(values, value)
+		return true
+	})
+	return values
+}
+
+func toBitmap(c container) *bitmapContainer {
+	if b, ok := c.(*bitmapContainer); ok {
+		return b
+	}
+	b := &bitmapContainer{words: make([]uint64, bitmapWords)}
+	c.each(false, func(value uint16) bool {
+		b.words[value>>6] |= 1 << (value & 63)
+		return true
+	})
+	b.n = c.cardinality()
+	return b
+}
+
+type arrayContainer []uint16
+
+func (c arrayContainer) cardinality() int {
+	return len(c)
+}
+
+func (c arrayContainer) contains(value uint16) bool {
+	i := c.search(value)
+	return i < len(c) && c[i] == value
+}
+
+func (c arrayContainer) search(value uint16) int {
+	lo, hi := 0, len(c)
+	for lo < hi {
+		m := int(uint(lo+hi) >> 1)
+		if c[m] < value {
+			lo = m + 1
+		} else {
+			hi = m
+		}
+	}
+	return lo
+}
+
+func (c arrayContainer) each(desc bool, fn func(value uint16) bool) bool {
+	if desc {
+		for i := len(c) - 1; i != -1; i-- {
+			if fn(c[i]) == false {
+				return false
+			}
+		}
+		return true
+	}
+	for _, value := range c {
+		if fn(value) == false {
+			return false
+		}
+	}
+	return true
+}
+
+func (c arrayContainer) add(value uint16) container {
+	if len(c) == arrayMax {
+		return toBitmap(c).add(value)
+	}
+	i := c.search(value)
+	c = append(c, 0)
+	copy(c[i+1:], c[i:])
+	c[i] = value
+	return c
+}
+
+func (c arrayContainer) remove(value uint16) container {
+	i := c.search(value)
+	return append(c[:i], c[i+1:]...)
+}
+
+func (c arrayContainer) filter(other container) arrayContainer {
+	values := make(arrayContainer, 0, len(c))
+	for _, value := range c {
+		if other.contains(value) {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+type bitmapContainer struct {
+	n     int
+	words []uint64
+}
+
+func (c *bitmapContainer) cardinality() int {
+	return c.n
+}
+
+func (c *bitmapContainer) contains(value uint16) bool {
+	return c.words[value>>6]&(1<<(value&63)) != 0
+}
+
+func (c *bitmapContainer) add(value uint16) container {
+	c.words[value>>6] |= 1 << (value & 63)
+	c.n++
+	return c
+}
+
+// converting back to an array only once it's well under arrayMax keeps a
+// container near the limit from being converted on every change
+func (c *bitmapContainer) remove(value uint16) container {
+	c.words[value>>6] &^= 1 << (value & 63)
+	c.n--
+	if c.n > arrayMax/2 {
+		return c
+	}
+	values := make(arrayContainer, 0, c.n)
+	c.each(false, func(value uint16) bool {
+		values = append(values, value)
+		return true
+	})
+	return values
+}
+
+func (c *bitmapContainer) each(desc bool, fn func(value uint16) bool) bool {
+	if desc {
+		for i := bitmapWords - 1; i != -1; i-- {
+			for word := c.words[i]; word != 0; {
+				bit := 63 - bits.LeadingZeros64(word)
+				word &^= 1 << uint(bit)
+				if fn(uint16(i<<6|bit)) == false {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	for i, word := range c.words {
+		for word != 0 {
+			bit := bits.TrailingZeros64(word)
+			word &= word - 1
+			if fn(uint16(i<<6|bit)) == false {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// an inclusive range of values
+type interval struct {
+	start uint16
+	last  uint16
+}
+
+type runContainer []interval
+
+func (c runContainer) cardinality() int {
+	n := 0
+	for _, run := range c {
+		n += int(run.last-run.start) + 1
+	}
+	return n
+}
+
+func (c runContainer) contains(value uint16) bool {
+	i := c.search(value)
+	return i < len(c) && c[i].start <= value
+}
+
+// the position of the first run which doesn't end before value
+func (c runContainer) search(value uint16) int {
+	lo, hi := 0, len(c)
+	for lo < hi {
+		m := int(uint(lo+hi) >> 1)
+		if c[m].last < value {
+			lo = m + 1
+		} else {
+			hi = m
+		}
+	}
+	return lo
+}
+
+// value either extends the run before or after it (or joins both) or
+// becomes a run of its own
+func (c runContainer) add(value uint16) container {
+	i := c.search(value)
+	before := i > 0 && c[i-1].last+1 == value
+	after := i < len(c) && c[i].start-1 == value
+	switch {
+	case before && after:
+		c[i-1].last = c[i].last
+		return append(c[:i], c[i+1:]...)
+	case before:
+		c[i-1].last = value
+	case after:
+		c[i].start = value
+	default:
+		c = append(c, interval{})
+		copy(c[i+1:], c[i:])
+		c[i] = interval{value, value}
+	}
+	return c
+}
+
+// removing a value from the middle of a run splits it in two
+func (c runContainer) remove(value uint16) container {
+	i := c.search(value)
+	run := c[i]
+	switch {
+	case run.start == run.last:
+		return append(c[:i], c[i+1:]...)
+	case run.start == value:
+		c[i].start++
+	case run.last == value:
+		c[i].last--
+	default:
+		c = append(c, interval{})
+		copy(c[i+2:], c[i+1:])
+		c[i].last = value - 1
+		c[i+1] = interval{value + 1, run.last}
+	}
+	return c
+}
+
+func (c runContainer) each(desc bool, fn func(value uint16) bool) bool {
+	if desc {
+		for i := len(c) - 1; i != -1; i-- {
+			for value := int(c[i].last); value >= int(c[i].start); value-- {
+				if fn(uint16(value)) == false {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	for _, run := range c {
+		for value := int(run.start); value <= int(run.last); value++ {
+			if fn(uint16(value)) == false {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package indexes
+
+import (
+	"testing"
+
+	. "github.com/karlseguin/expect"
+)
+
+type BitmapTests struct{}
+
+func Test_Bitmap(t *testing.T) {
+	Expectify(new(BitmapTests), t)
+}
+
+func (_ BitmapTests) ExistsInEachTypeOfContainer() {
+	set := NewBitmapSet(mixedIds())
+	Expect(set.Len()).To.Equal(5000 + 3 + 1000)
+	Expect(len(set.containers)).To.Equal(3)
+	_, isBitmap := set.containers[0].(*bitmapContainer)
+	_, isArray := set.containers[1].(arrayContainer)
+	_, isRun := set.containers[2].(runContainer)
+	Expect(isBitmap).To.Equal(true)
+	Expect(isArray).To.Equal(true)
+	Expect(isRun).To.Equal(true)
+
+	for _, id := range []Id{0, 2, 9998, 65536 + 7, 65536 + 70000%65536, 131072 + 100, 131072 + 1099} {
+		Expect(set.Exists(id)).To.Equal(true)
+	}
+	for _, id := range []Id{1, 9999, 10000, 65536, 131072 + 99, 131072 + 1100, 300000} {
+		Expect(set.Exists(id)).To.Equal(false)
+	}
+}
+
+func (_ BitmapTests) IgnoresDuplicates() {
+	set := NewBitmapSet([]Id{5, 3, 5, 3, 1})
+	Expect(set.Len()).To.Equal(3)
+	assertBitmap(set, false, 1, 3, 5)
+}
+
+func (_ BitmapTests) IteratesInOrder() {
+	set := NewBitmapSet([]Id{131072 + 1, 9, 65536 + 4, 7, 131072, 131073 + 1})
+	assertBitmap(set, false, 7, 9, 65540, 131072, 131073, 131074)
+	assertBitmap(set, true, 131074, 131073, 131072, 65540, 9, 7)
+}
+
+func (_ BitmapTests) IteratesABitmapContainerInOrder() {
+	set := NewBitmapSet(mixedIds())
+	var last Id
+	count := 0
+	set.Each(true, func(id Id) bool {
+		if count > 0 {
+			Expect(id < last).To.Equal(true)
+		}
+		last = id
+		count++
+		return true
+	})
+	Expect(count).To.Equal(set.Len())
+}
+
+func (_ BitmapTests) StopsIterating() {
+	set := NewBitmapSet(mixedIds())
+	count := 0
+	set.Each(false, func(id Id) bool {
+		count++
+		return count < 4
+	})
+	Expect(count).To.Equal(4)
+}
+
+func (_ BitmapTests) Intersects() {
+	other := make([]Id, 0)
+	for i := Id(0); i < 200000; i += 3 {
+		other = append(other, i)
+	}
+	a, b := NewBitmapSet(mixedIds()), NewBitmapSet(other)
+	and := a.And(b)
+	count := 0
+	a.Each(false, func(id Id) bool {
+		if id%3 == 0 {
+			Expect(and.Exists(id)).To.Equal(true)
+			count++
+		}
+		return true
+	})
+	Expect(and.Len()).To.Equal(count)
+	and.Each(false, func(id Id) bool {
+		Expect(id % 3).To.Equal(Id(0))
+		return true
+	})
+}
+
+func (_ BitmapTests) EstimatesTheCostOfIntersecting() {
+	every3rd := make([]Id, 0)
+	for i := Id(0); i < 3000000; i += 3 {
+		every3rd = append(every3rd, i)
+	}
+	small, huge := NewBitmapSet([]Id{2, 4, 6, 8, 10, 12, 14, 16, 18, 20}), NewBitmapSet(every3rd)
+	keys := len(huge.keys)
+	// only the one container they share is intersected, a value at a time
+	Expect(andCost(small, huge)).To.Equal(1 + keys + 10)
+	Expect(andCost(huge, huge)).To.Equal(keys*2 + keys*bitmapWords/wordsPerLookup)
+}
+
+func (_ BitmapTests) NewSetPicksABitmapForDenseIds() {
+	dense := make([]Id, 2000)
+	sparse := make([]Id, 2000)
+	for i := range dense {
+		dense[i] = Id(i * 2)
+		sparse[i] = Id(i * 100000)
+	}
+	_, ok := NewSet(dense).(*BitmapSet)
+	Expect(ok).To.Equal(true)
+	_, ok = NewSet(sparse).(*FixedSet)
+	Expect(ok).To.Equal(true)
+}
+
+func (_ BitmapTests) AddsAndRemovesInPlace() {
+	set := NewBitmapSet(mixedIds())
+	set.Add(1)
+	set.Add(65536 + 8)
+	set.Add(131072 + 1100)
+	set.Add(300000)
+	set.Add(2)
+	Expect(set.Len()).To.Equal(6003 + 4)
+	for _, id := range []Id{1, 65536 + 8, 131072 + 1100, 300000} {
+		Expect(set.Exists(id)).To.Equal(true)
+	}
+
+	set.Remove(1)
+	set.Remove(65536 + 7)
+	set.Remove(131072 + 500)
+	set.Remove(300000)
+	set.Remove(300001)
+	Expect(set.Len()).To.Equal(6003)
+	for _, id := range []Id{1, 65536 + 7, 131072 + 500, 300000} {
+		Expect(set.Exists(id)).To.Equal(false)
+	}
+	Expect(set.keys).To.Equal([]bitmapKey{0, 1, 2})
+
+	// an emptied container is dropped
+	for _, id := range []Id{65536 + 8, 65536 + 9, 65536 + 70000%65536} {
+		set.Remove(id)
+	}
+	Expect(set.keys).To.Equal([]bitmapKey{0, 2})
+}
+
+func (_ BitmapTests) SplitsAndJoinsRuns() {
+	set := NewBitmapSet([]Id{1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+	set.Remove(5)
+	set.Remove(1)
+	set.Remove(10)
+	Expect(set.containers[0]).To.Equal(runContainer{{2, 4}, {6, 9}})
+	set.Add(5)
+	set.Add(20)
+	set.Add(0)
+	Expect(set.containers[0]).To.Equal(runContainer{{0, 0}, {2, 9}, {20, 20}})
+	assertBitmap(set, false, 0, 2, 3, 4, 5, 6, 7, 8, 9, 20)
+	Expect(set.Len()).To.Equal(10)
+}
+
+func (_ BitmapTests) ConvertsContainersAsTheyChange() {
+	ids := make([]Id, arrayMax)
+	for i := range ids {
+		ids[i] = Id(i * 3)
+	}
+	set := NewBitmapSet(ids)
+	_, isArray := set.containers[0].(arrayContainer)
+	Expect(isArray).To.Equal(true)
+
+	set.Add(1)
+	_, isBitmap := set.containers[0].(*bitmapContainer)
+	Expect(isBitmap).To.Equal(true)
+
+	for i := 0; i <= arrayMax/2; i++ {
+		set.Remove(Id(i * 3))
+	}
+	_, isArray = set.containers[0].(arrayContainer)
+	Expect(isArray).To.Equal(true)
+	Expect(set.Len()).To.Equal(arrayMax / 2)
+	Expect(set.Exists(1), set.Exists((arrayMax/2+1)*3), set.Exists(3)).To.Equal(true, true, false)
+}
+
+// a bitmap container (5000 even ids), an array container (3 ids) and a
+// run container (1000 consecutive ids)
+func mixedIds() []Id {
+	ids := make([]Id, 0, 6003)
+	for i := 0; i < 5000; i++ {
+		ids = append(ids, Id(i*2))
+	}
+	ids = append(ids, 65536+7, 65536+70000%65536, 65536+9)
+	for i := 0; i < 1000; i++ {
+		ids = append(ids, Id(131072+100+i))
+	}
+	return ids
+}
+
+func assertBitmap(set *BitmapSet, desc bool, expected ...Id) {
+	actual := make([]Id, 0, len(expected))
+	set.Each(desc, func(id Id) bool {
+		actual = append(actual, id)
+		return true
+	})
+	Expect(actual).To.Equal(expected)
+}
@@ -0,0 +1,156 @@
+package indexes
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// A list, and its weight, in a blended sort
+type blendKey struct {
+	list   List
+	weight float64
+}
+
+// An id and its blended score
+type blended struct {
+	id    Id
+	score float64
+}
+
+// The blended ids kept while scanning, worst first so that it's cheap to
+// replace the worst one with a better match
+type blendHeap struct {
+	entries []blended
+	desc    bool
+}
+
+func (h *blendHeap) Len() int {
+	return len(h.entries)
+}
+
+func (h *blendHeap) Less(i, j int) bool {
+	return h.before(h.entries[j], h.entries[i])
+}
+
+func (h *blendHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+}
+
+func (h *blendHeap) Push(x interface{}) {
+	h.entries = append(h.entries, x.(blended))
+}
+
+func (h *blendHeap) Pop() interface{} {
+	l := len(h.entries) - 1
+	entry := h.entries[l]
+	h.entries = h.entries[:l]
+	return entry
+}
+
+// a lower score comes first (or last when desc), ties go to the lower id
+func (h *blendHeap) before(a blended, b blended) bool {
+	if a.score == b.score {
+		return a.id < b.id
+	}
+	return (a.score < b.score) != h.desc
+}
+
+// Sorts by a weighted sum of each id's rank in the named lists, lowest first.
+// An id missing from a list is ranked as though it was last, and one missing
+// from all of them isn't a match. Replaces any Sort.
+func (q *Query) Blend(weights map[string]float64) *Query {
+	q.blend = q.blend[:0]
+	for name, weight := range weights {
+		q.blend = append(q.blend, blendKey{q.db.GetList(name), weight})
+	}
+	return q
+}
+
+// whether the id is in any of the blended lists
+func (q *Query) inBlend(id Id) bool {
+	for _, key := range q.blend {
+		if key.list.Exists(id) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Query) blendScore(id Id) float64 {
+	score := 0.0
+	for _, key := range q.blend {
+		rank, exists := key.list.Rank(id)
+		if exists == false {
+			rank = key.list.Len()
+		}
+		score += key.weight * float64(rank)
+	}
+	return score
+}
+
+// Scores every candidate, keeping the best offset+limit. The candidates are
+// the smallest set's ids which are in a blended list, when it's small, or
+// else every id in the blended lists. Either way, the same ids match.
+func (q *Query) blendExecute() (Result, error) {
+	defer q.scannedAll()
+
+	wanted := q.offset + q.limit
+	top := &blendHeap{entries: q.blended[:0], desc: q.desc}
+	consider := func(id Id) {
+		q.result.total++
+		q.countFacets(id)
+		entry := blended{id, q.blendScore(id)}
+		if top.Len() < wanted {
+			heap.Push(top, entry)
+		} else if wanted > 0 && top.before(entry, top.entries[0]) {
+			top.entries[0] = entry
+			heap.Fix(top, 0)
+		}
+	}
+
+	l := q.sets.l
+	if l > 0 && q.sets.s[0].Len() < SmallSetTreshold {
+		q.explained(BlendStrategy, q.sets.n[0], q.sets.s[0].Len())
+		filter := q.notFilter(q.getFilter(l, 1))
+		q.sets.s[0].Each(false, func(id Id) bool {
+			q.scanned++
+			if filter(id) && q.inBlend(id) {
+				consider(id)
+			}
+			return true
+		})
+	} else {
+		estimated := 0
+		for _, key := range q.blend {
+			estimated += key.list.Len()
+		}
+		q.explained(BlendStrategy, "", estimated)
+		filter := q.notFilter(q.getFilter(l, 0))
+		for i, key := range q.blend {
+			key.list.Each(false, func(id Id) bool {
+				// already considered through an earlier list
+				for _, earlier := range q.blend[:i] {
+					if earlier.list.Exists(id) {
+						return true
+					}
+				}
+				q.scanned++
+				if filter(id) {
+					consider(id)
+				}
+				return true
+			})
+		}
+	}
+
+	entries := top.entries
+	sort.Slice(entries, func(i, j int) bool {
+		return top.before(entries[i], entries[j])
+	})
+	q.result.more = q.result.total > wanted
+	for i := q.offset; i < len(entries); i++ {
+		q.result.add(entries[i].id)
+	}
+	q.blended = entries[:0]
+	return q.result, nil
+}
@@ -1,15 +1,33 @@
 package indexes
 
+import "time"
+
+// the shortest interval the query pool checks for leaks or idle queries at
+const minPoolInterval = time.Millisecond
+
 type Configuration struct {
 	path       string
 	maxSets    int
 	maxResults int
+	storage    Storage
+	minQueries int
+	maxQueries int
+	queryIdle  time.Duration
+	reuseIds   bool
+	compactAt  int
+
+	leakThreshold time.Duration
+	leakReport    func(leak *Leak)
 }
 
 func Configure() *Configuration {
 	return &Configuration{
 		maxSets:    32,
 		maxResults: 100,
+		minQueries: 16,
+		maxQueries: 64,
+		queryIdle:  time.Minute,
+		compactAt:  32,
 		path:       "/tmp/indexes.db",
 	}
 }
@@ -34,3 +52,71 @@ func (c *Configuration) MaxSets(max uint8) *Configuration {
 	c.maxSets = int(max)
 	return c
 }
+
+// The number of queries the pool starts with, and the most it'll grow to
+// under load. Each query preallocates MaxResults and MaxSets sized buffers.
+// The pool always has room for at least 1 query.
+// [16, 64]
+func (c *Configuration) QueryPoolSize(min uint16, max uint16) *Configuration {
+	if max < min {
+		max = min
+	}
+	if max == 0 {
+		max = 1
+	}
+	c.minQueries = int(min)
+	c.maxQueries = int(max)
+	return c
+}
+
+// How long the queries the pool grew beyond its minimum size can go unused
+// before they're discarded. At least a millisecond.
+// [1 minute]
+func (c *Configuration) QueryPoolIdle(idle time.Duration) *Configuration {
+	if idle < minPoolInterval {
+		idle = minPoolInterval
+	}
+	c.queryIdle = idle
+	return c
+}
+
+// Let Updater.Assign hand out ids which have been deleted (IdsDelete) before
+// allocating new ones. A deleted id is only reused once it's been removed
+// from every set, list and numeric attribute.
+// [false]
+func (c *Configuration) ReuseIds() *Configuration {
+	c.reuseIds = true
+	return c
+}
+
+// The number of deltas a set is changed by, in place, before the updater
+// rewrites its payload in full. Storage merges a set's deltas whenever it's
+// loaded, so more deltas make commits cheaper but loads slower. 0 always
+// rewrites the payload.
+// [32]
+func (c *Configuration) CompactSetsAfter(deltas uint16) *Configuration {
+	c.compactAt = int(deltas)
+	return c
+}
+
+// The storage to load and persist indexes with. When set, Path is ignored.
+// NewMemoryStorage() can be used for tests and ephemeral databases
+// [sqlite storage at Path]
+func (c *Configuration) Storage(storage Storage) *Configuration {
+	c.storage = storage
+	return c
+}
+
+// Calls report for any query which has been checked out for longer than
+// threshold, which usually means Release() wasn't called on its result.
+// Each checkout is reported at most once. The threshold is at least a
+// millisecond.
+// [disabled]
+func (c *Configuration) LeakDetection(threshold time.Duration, report func(leak *Leak)) *Configuration {
+	if threshold < minPoolInterval {
+		threshold = minPoolInterval
+	}
+	c.leakThreshold = threshold
+	c.leakReport = report
+	return c
+}
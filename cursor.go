@@ -0,0 +1,232 @@
+package indexes
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync/atomic"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+
+	// every list gets a new version when it's created or changed. Versions
+	// start at a random point, so that a cursor from another process, or from
+	// before a restart, doesn't match the version of some other list.
+	listVersion = randomVersion()
+)
+
+const cursorSize = 12 + IdSize
+
+func nextListVersion() uint64 {
+	return atomic.AddUint64(&listVersion, 1)
+}
+
+func randomVersion() uint64 {
+	seed := make([]byte, 8)
+	rand.Read(seed)
+	return encoder.Uint64(seed)
+}
+
+// Where the last page ended: the last id, its rank and the version of the
+// sort at the time
+type cursor struct {
+	id      Id
+	rank    int
+	version uint64
+}
+
+// Lists which can tell whether they've changed
+type versioned interface {
+	Version() uint64
+}
+
+// Lists which can start iterating from a rank
+type seeker interface {
+	EachFrom(rank int, desc bool, fn func(id Id) bool)
+}
+
+func (c cursor) String() string {
+	buffer := make([]byte, cursorSize)
+	encoder.PutUint64(buffer, c.version)
+	encoder.PutUint32(buffer[8:], uint32(c.rank))
+	putId(buffer[12:], c.id)
+	return base64.RawURLEncoding.EncodeToString(buffer)
+}
+
+func parseCursor(token string) (cursor, error) {
+	buffer, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(buffer) != cursorSize {
+		return cursor{}, ErrInvalidCursor
+	}
+	return cursor{
+		version: encoder.Uint64(buffer),
+		rank:    int(encoder.Uint32(buffer[8:])),
+		id:      readId(buffer[12:]),
+	}, nil
+}
+
+// Resumes the query after the last id of a previous page, as returned by
+// the result's Cursor. If the sort has changed since, the query resumes
+// after the id's new rank or, if the id has been removed, from the rank it
+// used to have. Ignored for Around and Blend queries, or an empty cursor.
+func (q *Query) After(token string) *Query {
+	if token == "" {
+		return q
+	}
+	q.after, q.cursorErr = parseCursor(token)
+	q.resume = q.cursorErr == nil
+	return q
+}
+
+// The first rank the query should look at, moving in the query's direction
+func (q *Query) resumeFrom() int {
+	c := q.after
+	rank, exclusive := c.rank, true
+	if v, ok := q.sort.(versioned); ok == false || v.Version() != c.version {
+		if current, exists := q.sort.Rank(c.id); exists {
+			rank = current
+		} else {
+			// the ids after the removed one have moved up into its rank
+			exclusive = false
+		}
+	}
+	if q.desc {
+		return rank - 1
+	}
+	if exclusive {
+		return rank + 1
+	}
+	return rank
+}
+
+// A cursor taken within a run of ties which were broken: its rank is in the
+// sort's own order, not the order its page was returned in
+type tieResume struct {
+	active bool
+	score  float64
+	rank   int
+}
+
+// Resumes from the first rank of the cursor id's run of ties instead, so that
+// the run can be broken again. The ids of the run which were already returned
+// are skipped (tiedBefore).
+func (q *Query) resumeTied() {
+	scores, ties := q.sort.(scoredList)
+	seeker, seeks := q.sort.(seeker)
+	if ties == false || seeks == false || len(q.then) == 0 {
+		return
+	}
+	rank, exists := q.sort.Rank(q.after.id)
+	if exists == false {
+		return
+	}
+	score, _ := scores.Score(q.after.id)
+	first := rank
+	seeker.EachFrom(rank, !q.desc, func(id Id) bool {
+		if s, _ := scores.Score(id); s != score {
+			return false
+		}
+		first, _ = q.sort.Rank(id)
+		return true
+	})
+	q.from = first
+	q.afterTie = tieResume{true, score, rank}
+}
+
+// Whether the id is in the cursor id's run of ties and, once they're broken,
+// comes at or before it. Broken ties keep the sort's order among themselves.
+func (q *Query) tiedBefore(id Id) bool {
+	tie := q.afterTie
+	if tie.active == false {
+		return false
+	}
+	if score, _ := q.sort.(scoredList).Score(id); score != tie.score {
+		return false
+	}
+	if after := q.after.id; q.thenLess(id, after) {
+		return true
+	} else if q.thenLess(after, id) {
+		return false
+	}
+	rank, _ := q.sort.Rank(id)
+	if q.desc {
+		return rank >= tie.rank
+	}
+	return rank <= tie.rank
+}
+
+// Whether the rank comes at or after the resumed position
+func (q *Query) resumed(rank int) bool {
+	if q.desc {
+		return rank <= q.from
+	}
+	return rank >= q.from
+}
+
+// Counts the matches which come before the resumed position so that, as with
+// an Offset, the total and facets are those of the whole result rather than
+// of what's left of it. Only called when the query counts.
+func (q *Query) countResumed(filter Filter) {
+	q.sort.Each(q.desc, func(id Id) bool {
+		if rank, ok := q.sort.Rank(id); ok && q.resumed(rank) {
+			if q.afterTie.active == false {
+				return false
+			}
+			if score, _ := q.sort.(scoredList).Score(id); score != q.afterTie.score {
+				return false
+			}
+			if q.tiedBefore(id) == false {
+				return true
+			}
+		}
+		q.scanned++
+		if filter(id) {
+			q.result.total++
+			q.countFacets(id)
+		}
+		return q.counting()
+	})
+}
+
+// Walks the sort from the resumed position
+func (q *Query) eachResumed(fn func(id Id) bool) {
+	if seeker, ok := q.sort.(seeker); ok {
+		seeker.EachFrom(q.from, q.desc, fn)
+		return
+	}
+	q.sort.Each(q.desc, func(id Id) bool {
+		if rank, ok := q.sort.Rank(id); ok && q.resumed(rank) == false {
+			return true
+		}
+		return fn(id)
+	})
+}
+
+// A token to pass to the next query's After to get the following page. Empty
+// when there are no results or the sort can't rank its ids.
+func (r *NormalResult) Cursor() string {
+	if r.length == 0 {
+		return ""
+	}
+	list := r.query.sort
+	if list == nil || list.CanRank() == false {
+		return ""
+	}
+	last := r.ids[r.length-1]
+	list.RLock()
+	defer list.RUnlock()
+	rank, exists := list.Rank(last)
+	if exists == false {
+		return ""
+	}
+	c := cursor{id: last, rank: rank}
+	if v, ok := list.(versioned); ok {
+		c.version = v.Version()
+	}
+	return c.String()
+}
+
+func (r *emptyResult) Cursor() string {
+	return ""
+}
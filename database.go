@@ -1,6 +1,7 @@
 package indexes
 
 import (
+	"context"
 	"encoding/binary"
 	"sync"
 )
@@ -8,24 +9,83 @@ import (
 var (
 	Endianness     = binary.LittleEndian
 	DefaultPayload = []byte("null")
-	IdSize         = 4
 )
 
-type Id uint32
+// The type of a persisted index
+const (
+	IdsIndex      = 1
+	SetIndex      = 2
+	ListIndex     = 3
+	ScoredIndex   = 4
+	NumericIndex  = 5
+	SequenceIndex = 6
+)
+
+// Numeric attributes are persisted alongside the other indexes, with their
+// name in a namespace of their own, so that an attribute and a set or list
+// can share a name
+const numericPrefix = "numeric:"
+
+func numericId(name string) string {
+	return numericPrefix + name
+}
+
+// the id sequence is kept in a namespace of its own too, so that a set or
+// list named "sequence" neither replaces it nor is read as it
+const sequenceId = "sequence:ids"
 
 type Storage interface {
 	Close() error
 	ListCount() uint32
 	SetCount() uint32
-	LoadIds(newOnly bool) (map[string]Id, error)
-	EachSet(newOnly bool, f func(name string, ids []Id)) error
-	EachList(newOnly bool, f func(name string, ids []Id)) error
-	ClearNew() error
+	EachId(f func(external string, id Id)) error
+	LoadSequence() (next Id, freed []Id, err error)
+	EachSet(f func(name string, ids []Id)) error
+	EachList(f func(name string, ids []Id)) error
+	EachScored(f func(name string, ids []Id, scores []float64)) error
+	EachNumeric(f func(name string, ids []Id, values []float64)) error
+	Changes(f func(change *Change)) error
 	UpsertSet(id string, payload []byte) ([]Id, error)
 	UpsertList(id string, payload []byte) ([]Id, error)
 	RemoveSet(id string) error
 	RemoveList(id string) error
 	UpdateIds(blob []byte) (map[string]Id, error)
+	Begin() (Batch, error)
+}
+
+// A group of changes which are persisted atomically on Commit. A batch should
+// not be used once Commit or Rollback has been called.
+type Batch interface {
+	PutSet(id string, payload []byte) error
+	PutSetDelta(id string, added []byte, removed []byte) error
+	// The number of deltas the set has had since its payload was last written
+	// and whether it has a payload at all, as of this batch
+	SetDeltas(id string) (count int, exists bool, err error)
+	PutList(id string, payload []byte) error
+	PutId(external string, id Id) error
+	RemoveId(external string) error
+	PutSequence(payload []byte) error
+	PutScored(id string, payload []byte) error
+	// updated holds the ids whose score was set, with their scores, in the
+	// same format as the payload
+	PutScoredDelta(id string, updated []byte, removed []byte) error
+	ScoredDeltas(id string) (count int, exists bool, err error)
+	PutNumeric(id string, payload []byte) error
+	PutNumericDelta(id string, updated []byte, removed []byte) error
+	NumericDeltas(id string) (count int, exists bool, err error)
+	Commit() error
+	Rollback() error
+}
+
+// An index which was upserted or removed. For an upsert, the payload is the
+// index's current payload, with a set's deltas merged in. A change to an id
+// mapping has the IdsIndex type, the external id as its Id and the id as its
+// payload.
+type Change struct {
+	Id      string
+	Type    int
+	Removed bool
+	Payload []byte
 }
 
 type Resource interface {
@@ -34,14 +94,25 @@ type Resource interface {
 }
 
 type Database struct {
-	queries  QueryPool
-	idLock   sync.RWMutex
-	setLock  sync.RWMutex
-	listLock sync.RWMutex
-	storage  Storage
-	ids      map[string]Id
-	sets     map[string]Set
-	lists    map[string]List
+	queries     *QueryPool
+	idLock      sync.RWMutex
+	setLock     sync.RWMutex
+	listLock    sync.RWMutex
+	numericLock sync.RWMutex
+	storage     Storage
+	ids         map[string]Id
+	externals   map[Id]string
+	sequence    Id
+	freed       []Id
+	reuseIds    bool
+	sets        map[string]Set
+	compactAt   int
+	lists       map[string]List
+	numerics    map[string]*ScoredList
+
+	// held while locking several sets at once: exclusively by a writer, read
+	// by queries. A set is locked before, never under, the locks above.
+	lockOrder sync.RWMutex
 }
 
 func New(c *Configuration) (*Database, error) {
@@ -54,18 +125,31 @@ func New(c *Configuration) (*Database, error) {
 		return nil, err
 	}
 	database.storage = storage
-	database.queries = NewQueryPool(database, c.maxSets, c.maxResults)
+	database.queries = NewQueryPool(database, c)
 	return database, nil
 }
 
 func (db *Database) initialize(c *Configuration) (storage Storage, err error) {
-	storage, err = newSqliteStorage(c.path)
-	if err != nil {
+	if c.storage != nil {
+		storage = c.storage
+	} else if storage, err = newSqliteStorage(c.path); err != nil {
 		return nil, err
 	}
+	// databases sharing a memory storage each read its changes from their own
+	// position
+	if m, ok := storage.(memoryBacked); ok {
+		storage = m.memory().reader(storage)
+	}
 	db.sets = make(map[string]Set, storage.SetCount())
 	db.lists = make(map[string]List, storage.ListCount())
-	return storage, db.loadData(false, storage)
+	db.numerics = make(map[string]*ScoredList)
+	db.reuseIds = c.reuseIds
+	db.compactAt = c.compactAt
+	// skip whatever changed before now, it'll be part of the full load
+	if err := storage.Changes(func(change *Change) {}); err != nil {
+		return storage, err
+	}
+	return storage, db.load(storage)
 }
 
 // Returns the list. The list is unlocked; consumers are responsible for locking
@@ -81,6 +165,29 @@ func (db *Database) GetList(name string) List {
 	return l
 }
 
+// Returns the scored list. Like GetList, the list is unlocked.
+func (db *Database) GetScoredList(name string) *ScoredList {
+	db.listLock.RLock()
+	l, exists := db.lists[name]
+	db.listLock.RUnlock()
+	if scored, ok := l.(*ScoredList); exists && ok {
+		return scored
+	}
+	return EmptyScoredList
+}
+
+// Returns the numeric attribute, an id -> value index ordered by value. Like
+// GetList, the index is unlocked.
+func (db *Database) GetNumeric(name string) *ScoredList {
+	db.numericLock.RLock()
+	n, exists := db.numerics[name]
+	db.numericLock.RUnlock()
+	if exists == false {
+		return EmptyScoredList
+	}
+	return n
+}
+
 // Only have 1 updater operating on the database at a time
 func (db *Database) Update() *Updater {
 	return NewUpdater(db)
@@ -106,6 +213,14 @@ func (db *Database) GetMapping(id string) (Id, bool) {
 	return iid, exists
 }
 
+// The external id which maps to the id
+func (db *Database) GetExternalId(id Id) (string, bool) {
+	defer db.idLock.RUnlock()
+	db.idLock.RLock()
+	external, exists := db.externals[id]
+	return external, exists
+}
+
 func (db *Database) QueryIds(ids ...string) *Query {
 	iids := make(SimpleList, len(ids))
 	db.idLock.RLock()
@@ -116,12 +231,29 @@ func (db *Database) QueryIds(ids ...string) *Query {
 	return db.Query().SortList(iids)
 }
 
+// Blocks until a query is available
 func (db *Database) Query() *Query {
 	return db.queries.Checkout()
 }
 
+// Blocks until a query is available or the context is cancelled or times out
+func (db *Database) QueryContext(ctx context.Context) (*Query, error) {
+	return db.queries.CheckoutContext(ctx)
+}
+
+// Returns ErrNoQueryAvailable if every query is currently in use
+func (db *Database) TryQuery() (*Query, error) {
+	return db.queries.TryCheckout()
+}
+
+func (db *Database) QueryPoolStats() QueryPoolStats {
+	return db.queries.Stats()
+}
+
+// Applies the indexes which were upserted or removed in the storage since
+// the database was opened or last reloaded
 func (db *Database) Reload() error {
-	return db.loadData(true, db.storage)
+	return db.storage.Changes(db.apply)
 }
 
 func (db *Database) UpdateSet(name string, blob []byte) error {
@@ -171,33 +303,90 @@ func (db *Database) UpdateIds(blob []byte) error {
 		return err
 	}
 
+	db.setIds(ids)
+	return nil
+}
+
+// Replaces the ids along with their reverse mapping
+func (db *Database) setIds(ids map[string]Id) {
+	externals := reverseIds(ids)
 	db.idLock.Lock()
 	db.ids = ids
+	db.externals = externals
 	db.idLock.Unlock()
-	return nil
 }
 
-func (db *Database) getIds() map[string]Id {
-	defer db.idLock.Unlock()
+// The next id to assign and the ids which can be reused. A next of 0 means
+// no id was ever assigned, so assignment starts after the largest id in use.
+func (db *Database) setSequence(next Id, freed []Id) {
 	db.idLock.Lock()
-	return db.ids
+	defer db.idLock.Unlock()
+	if next == 0 {
+		next = 1
+		for _, id := range db.ids {
+			if id >= next {
+				next = nextId(id)
+			}
+		}
+	}
+	db.sequence = next
+	db.freed = freed
+}
+
+func (db *Database) getSequence() (Id, []Id) {
+	db.idLock.RLock()
+	defer db.idLock.RUnlock()
+	return db.sequence, append([]Id(nil), db.freed...)
+}
+
+// Callers must hold the idLock
+func (db *Database) mapId(external string, id Id) {
+	db.unmapId(external)
+	db.ids[external] = id
+	db.externals[id] = external
+}
+
+// Callers must hold the idLock
+func (db *Database) unmapId(external string) {
+	if id, exists := db.ids[external]; exists {
+		delete(db.ids, external)
+		if db.externals[id] == external {
+			delete(db.externals, id)
+		}
+	}
+}
+
+func reverseIds(ids map[string]Id) map[Id]string {
+	externals := make(map[Id]string, len(ids))
+	for external, id := range ids {
+		externals[id] = external
+	}
+	return externals
 }
 
 // Close the database
 func (db *Database) Close() error {
+	db.queries.close()
 	return db.storage.Close()
 }
 
-func (db *Database) loadData(newOnly bool, storage Storage) error {
-	ids, err := storage.LoadIds(newOnly)
+func (db *Database) load(storage Storage) error {
+	ids := make(map[string]Id)
+	err := storage.EachId(func(external string, id Id) {
+		ids[external] = id
+	})
 	if err != nil {
 		return err
 	}
-	db.idLock.Lock()
-	db.ids = ids
-	db.idLock.Unlock()
+	db.setIds(ids)
 
-	err = storage.EachSet(newOnly, func(name string, ids []Id) {
+	next, freed, err := storage.LoadSequence()
+	if err != nil {
+		return err
+	}
+	db.setSequence(next, freed)
+
+	err = storage.EachSet(func(name string, ids []Id) {
 		set := NewSet(ids)
 		db.setLock.Lock()
 		db.sets[name] = set
@@ -207,7 +396,7 @@ func (db *Database) loadData(newOnly bool, storage Storage) error {
 		return err
 	}
 
-	err = storage.EachList(newOnly, func(name string, ids []Id) {
+	err = storage.EachList(func(name string, ids []Id) {
 		list := NewList(ids)
 		db.listLock.Lock()
 		db.lists[name] = list
@@ -217,7 +406,178 @@ func (db *Database) loadData(newOnly bool, storage Storage) error {
 		db.sets[name] = list
 		db.setLock.Unlock()
 	})
-	return err
+	if err != nil {
+		return err
+	}
+
+	err = storage.EachScored(func(name string, ids []Id, scores []float64) {
+		list := NewScoredList(ids, scores)
+		db.listLock.Lock()
+		db.lists[name] = list
+		db.listLock.Unlock()
+
+		db.setLock.Lock()
+		db.sets[name] = list
+		db.setLock.Unlock()
+	})
+	if err != nil {
+		return err
+	}
+
+	return storage.EachNumeric(func(name string, ids []Id, values []float64) {
+		numeric := NewScoredList(ids, values)
+		db.numericLock.Lock()
+		db.numerics[name] = numeric
+		db.numericLock.Unlock()
+	})
+}
+
+func (db *Database) apply(change *Change) {
+	if change.Type == IdsIndex {
+		db.idLock.Lock()
+		if change.Removed {
+			db.unmapId(change.Id)
+		} else if len(change.Payload) >= IdSize {
+			db.mapId(change.Id, readId(change.Payload))
+		}
+		db.idLock.Unlock()
+		return
+	}
+	if change.Type == SequenceIndex {
+		var next Id
+		var freed []Id
+		if change.Removed == false {
+			next, freed = extractSequence(change.Payload)
+		}
+		db.setSequence(next, freed)
+		return
+	}
+
+	if change.Type == NumericIndex {
+		db.numericLock.Lock()
+		delete(db.numerics, change.Id)
+		if change.Removed == false {
+			db.numerics[change.Id] = NewScoredList(extractScoresFromIndex(change.Payload))
+		}
+		db.numericLock.Unlock()
+		return
+	}
+
+	db.setLock.Lock()
+	db.listLock.Lock()
+	delete(db.lists, change.Id)
+	delete(db.sets, change.Id)
+	if change.Removed == false {
+		switch change.Type {
+		case ListIndex:
+			list := NewList(extractIdsFromIndex(change.Payload))
+			db.lists[change.Id] = list
+			db.sets[change.Id] = list
+		case ScoredIndex:
+			list := NewScoredList(extractScoresFromIndex(change.Payload))
+			db.lists[change.Id] = list
+			db.sets[change.Id] = list
+		default:
+			db.sets[change.Id] = NewSet(extractIdsFromIndex(change.Payload))
+		}
+	}
+	db.listLock.Unlock()
+	db.setLock.Unlock()
+}
+
+// Replaces the sets and lists, patches sets in place, and changes the id
+// mappings, together. An id of 0 removes the mapping. A patched set which was
+// replaced since its delta was computed already reflects storage, and is
+// left alone.
+func (db *Database) swap(sets map[string][]Id, lists map[string][]Id, patches map[string]setPatch, ids map[string]Id) {
+	built := make(map[string]Set, len(sets))
+	for name, s := range sets {
+		built[name] = NewSet(s)
+	}
+	ranked := make(map[string]List, len(lists))
+	for name, l := range lists {
+		ranked[name] = NewList(l)
+	}
+
+	db.lockOrder.Lock()
+	for _, p := range patches {
+		p.set.Lock()
+	}
+	db.lockOrder.Unlock()
+	defer func() {
+		for _, p := range patches {
+			p.set.Unlock()
+		}
+	}()
+
+	db.idLock.Lock()
+	db.setLock.Lock()
+	db.listLock.Lock()
+	for external, id := range ids {
+		if id == 0 {
+			db.unmapId(external)
+		} else {
+			db.mapId(external, id)
+		}
+	}
+	for name, p := range patches {
+		if current, exists := db.sets[name]; exists && current == Set(p.set) {
+			for _, id := range p.removed {
+				p.set.Remove(id)
+			}
+			for _, id := range p.added {
+				p.set.Add(id)
+			}
+		}
+	}
+	for name, set := range built {
+		db.sets[name] = set
+	}
+	for name, list := range ranked {
+		db.lists[name] = list
+		db.sets[name] = list
+	}
+	db.listLock.Unlock()
+	db.setLock.Unlock()
+	db.idLock.Unlock()
+}
+
+// Applies score changes to the live scored lists, creating any which don't
+// exist from their serialized form
+func (db *Database) rescore(scores map[string]ScoreChanges, created map[string][]byte) {
+	for name, changes := range scores {
+		db.listLock.RLock()
+		list, exists := db.lists[name].(*ScoredList)
+		db.listLock.RUnlock()
+		if exists == false {
+			list = NewScoredList(extractScoresFromIndex(created[name]))
+			db.setLock.Lock()
+			db.listLock.Lock()
+			db.lists[name] = list
+			db.sets[name] = list
+			db.listLock.Unlock()
+			db.setLock.Unlock()
+			continue
+		}
+		list.apply(changes)
+	}
+}
+
+// Like rescore, but for numeric attributes
+func (db *Database) revalue(values map[string]ScoreChanges, created map[string][]byte) {
+	for name, changes := range values {
+		db.numericLock.RLock()
+		numeric, exists := db.numerics[name]
+		db.numericLock.RUnlock()
+		if exists == false {
+			numeric = NewScoredList(extractScoresFromIndex(created[name]))
+			db.numericLock.Lock()
+			db.numerics[name] = numeric
+			db.numericLock.Unlock()
+			continue
+		}
+		numeric.apply(changes)
+	}
 }
 
 func (db *Database) setSet(name string, ids []Id) error {
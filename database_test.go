@@ -1,7 +1,13 @@
 package indexes
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
 	. "github.com/karlseguin/expect"
 )
@@ -37,6 +43,187 @@ func (_ DatabaseTests) ReloadLoadsANewSet() {
 	Expect(res.Len()).To.Equal(3)
 }
 
+func (_ DatabaseTests) ReloadRemovesDeletedIndexes() {
+	db := createDB()
+	fakeNewIndexes(db)
+	db.Close()
+
+	db = createDB()
+	defer db.Close()
+	Expect(db.GetSet("late_set").Len()).To.Equal(3)
+	Expect(db.GetList("late_list").Len()).To.Equal(2)
+
+	sql := db.storage.(*SqliteStorage)
+	sql.Exec("delete from indexes where id like 'late_%'")
+	db.Reload()
+	Expect(db.GetSet("late_set").Len()).To.Equal(0)
+	Expect(db.GetSet("late_list").Len()).To.Equal(0)
+	Expect(db.GetList("late_list").Len()).To.Equal(0)
+}
+
+func (_ DatabaseTests) ReloadOnlyAppliesChangesOnce() {
+	db := createDB()
+	defer db.Close()
+	fakeNewIndexes(db)
+	db.Reload()
+	set := db.GetSet("late_set")
+	db.Reload()
+	Expect(db.GetSet("late_set") == set).To.Equal(true)
+}
+
+func (_ DatabaseTests) EveryDatabaseOnAFileReloadsTheSameChanges() {
+	dir, _ := ioutil.TempDir("", "indexes")
+	defer os.RemoveAll(dir)
+	c := Configure().Path(path.Join(dir, "shared.db"))
+	first, _ := New(c)
+	defer first.Close()
+	second, _ := New(c)
+	defer second.Close()
+
+	Expect(first.UpdateSet("odd", encodeIds([]Id{1, 3}))).To.Equal(nil)
+	// opening a database doesn't read the changes of the others
+	third, _ := New(c)
+	defer third.Close()
+
+	var changes int
+	sql := first.storage.(*SqliteStorage)
+	Expect(first.Reload()).To.Equal(nil)
+	sql.QueryRow("select count(*) from changes").Scan(&changes)
+	Expect(changes).To.Equal(1)
+
+	// discarded once every database has read it
+	Expect(second.Reload()).To.Equal(nil)
+	Expect(second.GetSet("odd").Len()).To.Equal(2)
+	sql.QueryRow("select count(*) from changes").Scan(&changes)
+	Expect(changes).To.Equal(0)
+
+	// a database which was forgotten can't know what it missed
+	sql.Exec("delete from readers where id = ?", third.storage.(*SqliteStorage).reader)
+	Expect(third.Reload()).To.Equal(ErrChangesExpired)
+}
+
+func (_ DatabaseTests) DiscardsChangesWithoutReloading() {
+	dir, _ := ioutil.TempDir("", "indexes")
+	defer os.RemoveAll(dir)
+	c := Configure().Path(path.Join(dir, "commits.db"))
+	db, _ := New(c)
+	sql := db.storage.(*SqliteStorage)
+
+	var changes int
+	for i := Id(1); i <= 200; i++ {
+		updater := db.Update()
+		updater.SetUpdate("odd", i)
+		updater.IdsUpdate(string(rune('a'+i%26)), i)
+		Expect(updater.Commit()).To.Equal(nil)
+	}
+	sql.QueryRow("select count(*) from changes").Scan(&changes)
+	Expect(changes).To.Equal(0)
+
+	// another database's changes are kept until it's read them, or is closed
+	other, _ := New(c)
+	updater := db.Update()
+	updater.SetUpdate("odd", 201)
+	Expect(updater.Commit()).To.Equal(nil)
+	sql.QueryRow("select count(*) from changes").Scan(&changes)
+	Expect(changes).To.Equal(1)
+	other.Close()
+	db.Close()
+
+	db, _ = New(c)
+	defer db.Close()
+	db.storage.(*SqliteStorage).QueryRow("select count(*) from changes").Scan(&changes)
+	Expect(changes, db.GetSet("odd").Len()).To.Equal(0, 201)
+}
+
+func (_ DatabaseTests) EveryDatabaseOnAMemoryStorageReloadsTheSameChanges() {
+	storage := NewMemoryStorage()
+	first, _ := New(Configure().Storage(storage))
+	defer first.Close()
+	second, _ := New(Configure().Storage(storage))
+	defer second.Close()
+
+	storage.UpsertSet("odd", encodeIds([]Id{1, 3}))
+	updater := first.Update()
+	updater.IdsUpdate("1r", 1)
+	Expect(updater.Commit()).To.Equal(nil)
+	// opening a database doesn't read the changes of the others
+	third, _ := New(Configure().Storage(storage))
+	defer third.Close()
+
+	for _, db := range []*Database{first, second} {
+		Expect(len(storage.changes) > 0).To.Equal(true)
+		Expect(db.Reload()).To.Equal(nil)
+		id, _ := db.GetMapping("1r")
+		Expect(db.GetSet("odd").Len(), id).To.Equal(2, Id(1))
+	}
+	// discarded once every database has read them
+	Expect(len(storage.changes)).To.Equal(0)
+}
+
+func (_ DatabaseTests) ReloadAppliesIdChanges() {
+	db := createDB()
+	defer db.Close()
+	sql := db.storage.(*SqliteStorage)
+
+	sql.Exec("insert into ids (external, id) values ('late_id', 40)")
+	db.Reload()
+	id, _ := db.GetMapping("late_id")
+	Expect(id).To.Equal(Id(40))
+	external, _ := db.GetExternalId(40)
+	Expect(external).To.Equal("late_id")
+
+	sql.Exec("delete from ids where external = 'late_id'")
+	db.Reload()
+	_, exists := db.GetMapping("late_id")
+	Expect(exists).To.Equal(false)
+	_, exists = db.GetExternalId(40)
+	Expect(exists).To.Equal(false)
+	id, _ = db.GetMapping("8r")
+	Expect(id).To.Equal(Id(7))
+}
+
+// test.db is created with an "ids" index, like a database which predates
+// the ids table
+func (_ DatabaseTests) MovesTheIdMapIntoItsOwnTable() {
+	db := createDB()
+	defer db.Close()
+	sql := db.storage.(*SqliteStorage)
+
+	var indexes, ids int
+	sql.QueryRow("select count(*) from indexes where id = 'ids'").Scan(&indexes)
+	sql.QueryRow("select count(*) from ids").Scan(&ids)
+	Expect(indexes, ids).To.Equal(0, 15)
+
+	// only as a migration, not every time the database is opened
+	sql.Exec("insert into indexes (id, payload, type) values ('ids', ?, 1)", mapping("ab", 7))
+	reopened := createDB()
+	defer reopened.Close()
+	_, exists := reopened.GetMapping("ab")
+	Expect(exists).To.Equal(false)
+	sql.Exec("delete from indexes where id = 'ids'")
+}
+
+func (_ DatabaseTests) ReloadsFromMemoryStorage() {
+	storage := NewMemoryStorage()
+	db, _ := New(Configure().Storage(storage))
+	defer db.Close()
+
+	storage.UpsertSet("odd", encodeIds([]Id{1, 3}))
+	storage.UpsertList("recent", encodeIds([]Id{3}))
+	storage.UpdateIds(mapping("3r", 3))
+	Expect(db.GetSet("odd").Len()).To.Equal(0)
+	db.Reload()
+	Expect(db.GetSet("odd").Len()).To.Equal(2)
+	Expect(db.GetList("recent").Len()).To.Equal(1)
+	id, _ := db.GetMapping("3r")
+	Expect(id).To.Equal(Id(3))
+
+	storage.RemoveSet("odd")
+	db.Reload()
+	Expect(db.GetSet("odd").Len()).To.Equal(0)
+	Expect(db.GetList("recent").Len()).To.Equal(1)
+}
+
 func (_ DatabaseTests) QueriesIds() {
 	db := createDB()
 	defer db.Close()
@@ -57,10 +244,7 @@ func (_ DatabaseTests) QueryIdsNull() {
 }
 
 func (_ DatabaseTests) QueryIdsDoesntOverflow() {
-	QueryPoolSize = 1
-	defer func() { QueryPoolSize = 10 }()
-
-	db := createDB()
+	db, _ := New(Configure().Path("./test.db").QueryPoolSize(1, 1))
 	defer db.Close()
 	result, _ := db.QueryIds("8r", "7r").Execute()
 	result.Release()
@@ -72,26 +256,201 @@ func (_ DatabaseTests) QueryIdsDoesntOverflow() {
 	Expect(ids[1]).To.Eql(0)
 }
 
+func (_ DatabaseTests) ReadsBothIdMapFormats() {
+	db, _ := New(Configure().Storage(NewMemoryStorage()))
+	defer db.Close()
+
+	Expect(db.UpdateIds(mapping("ab", 7))).To.Equal(nil)
+	id, _ := db.GetMapping("ab")
+	Expect(id).To.Equal(Id(7))
+
+	key := strings.Repeat("k", 300)
+	payload := append([]byte{0, 2, 0xac, 0x02}, key...)
+	Expect(db.UpdateIds(append(payload, encodeIds([]Id{9})...))).To.Equal(nil)
+	id, _ = db.GetMapping(key)
+	Expect(id).To.Equal(Id(9))
+}
+
+func (_ DatabaseTests) RejectsMalformedIdMaps() {
+	db, _ := New(Configure().Storage(NewMemoryStorage()))
+	defer db.Close()
+
+	Expect(db.UpdateIds(mapping("ab", 7))).To.Equal(nil)
+	Expect(db.UpdateIds([]byte{5, 'a', 'b', 7, 0})).To.Equal(ErrInvalidIdMap)
+	Expect(db.UpdateIds([]byte{0, 2, 0xff})).To.Equal(ErrInvalidIdMap)
+	Expect(db.UpdateIds([]byte{0, 2, 1, 'a', 1, 0})).To.Equal(ErrInvalidIdMap)
+	id, _ := db.GetMapping("ab")
+	Expect(id).To.Equal(Id(7))
+}
+
+func (_ DatabaseTests) UsesTheConfiguredStorage() {
+	storage := NewMemoryStorage()
+	storage.UpsertList("recent", encodeIds([]Id{3, 1, 2}))
+	db, err := New(Configure().Storage(storage))
+	Expect(err).To.Equal(nil)
+	defer db.Close()
+
+	Expect(db.UpdateSet("odd", encodeIds([]Id{1, 3}))).To.Equal(nil)
+	result, _ := db.Query().Sort("recent").And("odd").Execute()
+	assertResult(result, 3, 1)
+
+	Expect(db.RemoveSet("odd")).To.Equal(nil)
+	Expect(storage.SetCount()).To.Equal(uint32(0))
+	Expect(storage.ListCount()).To.Equal(uint32(1))
+}
+
+func (_ DatabaseTests) MemoryStorageLoadsExistingIndexes() {
+	storage := NewMemoryStorage()
+	storage.UpdateIds(mapping("1r", 1))
+	storage.UpsertSet("odd", encodeIds([]Id{1, 3}))
+	db, _ := New(Configure().Storage(storage))
+	defer db.Close()
+
+	id, exists := db.GetMapping("1r")
+	Expect(id).To.Equal(Id(1))
+	Expect(exists).To.Equal(true)
+	Expect(db.GetSet("odd").Len()).To.Equal(2)
+}
+
+func (_ DatabaseTests) CreatesTheSchemaForANewPath() {
+	dir, _ := ioutil.TempDir("", "indexes")
+	defer os.RemoveAll(dir)
+	c := Configure().Path(path.Join(dir, "new.db"))
+
+	db, err := New(c)
+	Expect(err).To.Equal(nil)
+	Expect(db.UpdateSet("odd", encodeIds([]Id{1, 3}))).To.Equal(nil)
+	Expect(db.UpdateSet("odd", encodeIds([]Id{5}))).To.Equal(nil)
+	db.Close()
+
+	db, err = New(c)
+	Expect(err).To.Equal(nil)
+	defer db.Close()
+	Expect(db.GetSet("odd").Len()).To.Equal(1)
+	Expect(db.storage.SetCount()).To.Equal(uint32(1))
+
+	version := 0
+	db.storage.(*SqliteStorage).QueryRow("pragma user_version").Scan(&version)
+	Expect(version).To.Equal(len(migrations))
+}
+
+// an id map entry: the external id's length, the external id, then the id
+func mapping(external string, id Id) []byte {
+	return append(append([]byte{byte(len(external))}, external...), encodeIds([]Id{id})...)
+}
+
+func (_ DatabaseTests) TryQueryWhenExhausted() {
+	db, _ := New(Configure().Path("./test.db").QueryPoolSize(1, 1))
+	defer db.Close()
+	query, err := db.TryQuery()
+	Expect(err).To.Equal(nil)
+
+	_, err = db.TryQuery()
+	Expect(err).To.Equal(ErrNoQueryAvailable)
+
+	result, _ := query.Sort("recent").Limit(1).Execute()
+	result.Release()
+	query, err = db.TryQuery()
+	Expect(err).To.Equal(nil)
+	Expect(query == nil).To.Equal(false)
+}
+
+func (_ DatabaseTests) QueryContextTimesOut() {
+	db, _ := New(Configure().Path("./test.db").QueryPoolSize(1, 1))
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*5)
+	defer cancel()
+	_, err := db.QueryContext(ctx)
+	Expect(err).To.Equal(nil)
+
+	_, err = db.QueryContext(ctx)
+	Expect(err).To.Equal(context.DeadlineExceeded)
+}
+
+func (_ DatabaseTests) ReportsLeakedQueries() {
+	leaks := make(chan *Leak, 2)
+	db, _ := New(Configure().Path("./test.db").QueryPoolSize(2, 2).LeakDetection(time.Millisecond*10, func(leak *Leak) {
+		leaks <- leak
+	}))
+	defer db.Close()
+
+	result, _ := db.Query().Sort("recent").Execute()
+	result.Release()
+	db.Query()
+
+	leak := <-leaks
+	Expect(leak.Duration > time.Millisecond*10).To.Equal(true)
+	Expect(len(leak.Stack) > 0).To.Equal(true)
+	time.Sleep(time.Millisecond * 30)
+	Expect(len(leaks)).To.Equal(0)
+}
+
+func (_ DatabaseTests) ReportsLeaksWithAThresholdOfZero() {
+	leaks := make(chan *Leak, 1)
+	db, _ := New(Configure().Path("./test.db").QueryPoolSize(1, 1).LeakDetection(0, func(leak *Leak) {
+		leaks <- leak
+	}))
+	defer db.Close()
+
+	db.Query()
+	leak := <-leaks
+	Expect(leak.Duration >= time.Millisecond).To.Equal(true)
+}
+
+func (_ DatabaseTests) QueryPoolGrowsAndShrinks() {
+	db, _ := New(Configure().Path("./test.db").QueryPoolSize(1, 3).QueryPoolIdle(time.Millisecond * 20))
+	defer db.Close()
+	Expect(db.QueryPoolStats()).To.Equal(QueryPoolStats{Min: 1, Max: 3, Size: 1, InUse: 0})
+
+	q1, q2, q3 := db.Query(), db.Query(), db.Query()
+	Expect(db.QueryPoolStats()).To.Equal(QueryPoolStats{Min: 1, Max: 3, Size: 3, InUse: 3})
+	_, err := db.TryQuery()
+	Expect(err).To.Equal(ErrNoQueryAvailable)
+
+	for _, q := range []*Query{q1, q2, q3} {
+		result, _ := q.Sort("recent").Execute()
+		result.Release()
+	}
+	Expect(db.QueryPoolStats().InUse).To.Equal(0)
+	time.Sleep(time.Millisecond * 60)
+	Expect(db.QueryPoolStats()).To.Equal(QueryPoolStats{Min: 1, Max: 3, Size: 1, InUse: 0})
+}
+
+func (_ DatabaseTests) QueryPoolKeepsQueriesWhichAreUsed() {
+	db, _ := New(Configure().Path("./test.db").QueryPoolSize(0, 2).QueryPoolIdle(time.Millisecond * 20))
+	defer db.Close()
+	q := db.Query()
+	time.Sleep(time.Millisecond * 50)
+	Expect(db.QueryPoolStats()).To.Equal(QueryPoolStats{Min: 0, Max: 2, Size: 1, InUse: 1})
+	q.Execute()
+}
+
+func (_ DatabaseTests) QueryPoolSizeAndIdleAreClamped() {
+	db, _ := New(Configure().Path("./test.db").QueryPoolSize(0, 0).QueryPoolIdle(0))
+	defer db.Close()
+	Expect(db.QueryPoolStats()).To.Equal(QueryPoolStats{Min: 0, Max: 1, Size: 0, InUse: 0})
+	result, _ := db.Query().Sort("recent").Execute()
+	result.Release()
+}
+
 func (_ DatabaseTests) Each(t func()) {
 	sql, _ := newSqliteStorage("test.db")
-	_, err := sql.Exec("delete from indexes where id like 'late_%'; delete from updated;")
+	_, err := sql.Exec("delete from indexes where id like 'late_%'")
 	if err != nil {
 		panic(err)
 	}
+	if _, err := sql.Exec("delete from ids where external like 'late_%'"); err != nil {
+		panic(err)
+	}
 	sql.Close()
 	t()
 }
 
 func fakeNewIndexes(db *Database) {
 	sql := db.storage.(*SqliteStorage)
-	_, err := sql.Exec("insert into updated (id, type) values ('late_set', 2), ('late_list', 3)")
-	if err != nil {
-		panic(err)
-	}
-
-	set := []byte{1, 0, 0, 0, 4, 0, 0, 0, 10, 0, 0, 0}
-	list := []byte{8, 0, 0, 0, 10, 0, 0, 0}
-	_, err = sql.Exec("insert into indexes (id, payload, type) values ('late_set', ?, 2), ('late_list', ?, 3)", set, list)
+	set := encodeIds([]Id{1, 4, 10})
+	list := encodeIds([]Id{8, 10})
+	_, err := sql.Exec("insert into indexes (id, payload, type) values ('late_set', ?, 2), ('late_list', ?, 3)", set, list)
 	if err != nil {
 		panic(err)
 	}
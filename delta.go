@@ -0,0 +1,113 @@
+package indexes
+
+import "math"
+
+// The ids a commit added to and removed from a set. Rather than rewriting a
+// set's payload, the updater persists its deltas and applies them to the live
+// set in place. Storage merges a set's deltas, oldest first, into its payload
+// when loading it, until a full payload is written again.
+type setDelta struct {
+	added   []Id
+	removed []Id
+}
+
+// A delta as storage keeps it. For a set, added holds ids. For a scored list
+// or numeric attribute, it holds the ids whose score was set, with their
+// scores, in the same format as the payload.
+type storedDelta struct {
+	added   []byte
+	removed []byte
+}
+
+// The payload of an index of the given type with its deltas merged in
+func mergePayload(tpe int, payload []byte, deltas []storedDelta) []byte {
+	if len(deltas) == 0 {
+		return payload
+	}
+	if tpe == ScoredIndex || tpe == NumericIndex {
+		ids, scores := extractScoresFromIndex(payload)
+		return encodeScores(mergeScoreDeltas(ids, scores, deltas))
+	}
+	return encodeIds(mergeDeltas(extractIdsFromIndex(payload), deltas))
+}
+
+// Applies the deltas, in order, to the ids of a set
+func mergeDeltas(ids []Id, deltas []storedDelta) []Id {
+	if len(deltas) == 0 {
+		return ids
+	}
+	// only the ids touched by a delta need tracking: true if the id ends up in
+	// the set, false if it doesn't
+	touched := make(map[Id]bool)
+	for _, delta := range deltas {
+		for _, id := range extractIdsFromIndex(delta.added) {
+			touched[id] = true
+		}
+		for _, id := range extractIdsFromIndex(delta.removed) {
+			touched[id] = false
+		}
+	}
+
+	merged := make([]Id, 0, len(ids))
+	existing := make(map[Id]struct{})
+	for _, id := range ids {
+		if in, exists := touched[id]; exists {
+			if in == false {
+				continue
+			}
+			existing[id] = struct{}{}
+		}
+		merged = append(merged, id)
+	}
+	for id, in := range touched {
+		if _, exists := existing[id]; in && exists == false {
+			merged = append(merged, id)
+		}
+	}
+	return merged
+}
+
+// Applies the deltas, in order, to the ids and scores of a scored list. The
+// merged entries aren't in any order, the list sorts them when it's loaded.
+func mergeScoreDeltas(ids []Id, scores []float64, deltas []storedDelta) ([]Id, []float64) {
+	if len(deltas) == 0 {
+		return ids, scores
+	}
+	merged := make(map[Id]float64, len(ids))
+	for i, id := range ids {
+		merged[id] = scores[i]
+	}
+	for _, delta := range deltas {
+		updated, values := extractScoresFromIndex(delta.added)
+		for i, id := range updated {
+			merged[id] = values[i]
+		}
+		for _, id := range extractIdsFromIndex(delta.removed) {
+			delete(merged, id)
+		}
+	}
+	ids, scores = make([]Id, 0, len(merged)), make([]float64, 0, len(merged))
+	for id, score := range merged {
+		ids = append(ids, id)
+		scores = append(scores, score)
+	}
+	return ids, scores
+}
+
+func encodeIds(ids []Id) []byte {
+	payload := make([]byte, len(ids)*IdSize)
+	for i, id := range ids {
+		putId(payload[i*IdSize:], id)
+	}
+	return payload
+}
+
+func encodeScores(ids []Id, scores []float64) []byte {
+	payload := make([]byte, len(ids)*(IdSize+8))
+	for i, id := range ids {
+		entry := payload[i*(IdSize+8):]
+		putId(entry, id)
+		encoder.PutUint64(entry[IdSize:], math.Float64bits(scores[i]))
+	}
+	return payload
+}
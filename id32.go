@@ -0,0 +1,67 @@
+//go:build !ids64
+// +build !ids64
+
+package indexes
+
+import (
+	"sync"
+
+	"gopkg.in/karlseguin/intset.v1"
+)
+
+// Ids are 32 bits, unless built with the ids64 tag
+type Id uint32
+
+// The number of bytes an id takes in a payload
+const IdSize = 4
+
+// the high bits of an id, which group ids in a BitmapSet
+type bitmapKey uint16
+
+func readId(b []byte) Id {
+	return Id(encoder.Uint32(b))
+}
+
+func putId(b []byte, id Id) {
+	encoder.PutUint32(b, uint32(id))
+}
+
+func newFixedSet(ids []Id) Set {
+	l := len(ids)
+	set := intset.NewSized32(uint32(l))
+	for i := 0; i < l; i++ {
+		set.Set(uint32(ids[i]))
+	}
+	return &FixedSet{
+		ids: set,
+	}
+}
+
+type FixedSet struct {
+	sync.RWMutex
+	ids *intset.Sized32
+}
+
+func (s *FixedSet) Len() int {
+	return s.ids.Len()
+}
+
+func (s *FixedSet) Exists(value Id) bool {
+	return s.ids.Exists(uint32(value))
+}
+
+func (s *FixedSet) Each(desc bool, fn func(Id) bool) {
+	s.ids.Each(func(id uint32) {
+		if !fn(Id(id)) {
+			return
+		}
+	})
+}
+
+func (s *FixedSet) Add(id Id) {
+	s.ids.Set(uint32(id))
+}
+
+func (s *FixedSet) Remove(id Id) {
+	s.ids.Remove(uint32(id))
+}
@@ -0,0 +1,65 @@
+//go:build !ids64
+// +build !ids64
+
+package indexes
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "github.com/karlseguin/expect"
+)
+
+func (_ DatabaseTests) ResizesIdsWrittenWithADifferentSize() {
+	dir, _ := ioutil.TempDir("", "indexes")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "wide.db")
+
+	storage, _ := newSqliteStorage(p)
+	storage.Exec("update settings set value = 8 where key = 'id_size'")
+	storage.Exec("insert into indexes (id, payload, type) values ('odd', ?, 2), ('points', ?, 4), ('even', ?, 2)",
+		wideIds(1, 3), append(wideIds(2), 0, 0, 0, 0, 0, 0, 0xf8, 0x3f), wideIds(2))
+	storage.Exec("insert into deltas (id, type, added, removed) values ('even', 2, ?, ?), ('points', 4, ?, ?)",
+		wideIds(4, 6), wideIds(2), append(wideIds(3), 0, 0, 0, 0, 0, 0, 0, 0x40), wideIds())
+	storage.Close()
+
+	db, err := New(Configure().Path(p))
+	Expect(err).To.Equal(nil)
+	defer db.Close()
+	set := db.GetSet("odd")
+	Expect(set.Len(), set.Exists(1), set.Exists(3)).To.Equal(2, true, true)
+	set = db.GetSet("even")
+	Expect(set.Len(), set.Exists(4), set.Exists(6)).To.Equal(2, true, true)
+	score, _ := db.GetScoredList("points").Score(2)
+	Expect(score).To.Equal(1.5)
+	score, _ = db.GetScoredList("points").Score(3)
+	Expect(score).To.Equal(2.0)
+
+	size := 0
+	db.storage.(*SqliteStorage).QueryRow("select value from settings where key = 'id_size'").Scan(&size)
+	Expect(size).To.Equal(IdSize)
+}
+
+func (_ DatabaseTests) RefusesToResizeIdsWhichDontFit() {
+	dir, _ := ioutil.TempDir("", "indexes")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "wide.db")
+
+	storage, _ := newSqliteStorage(p)
+	storage.Exec("update settings set value = 8 where key = 'id_size'")
+	storage.Exec("insert into indexes (id, payload, type) values ('large', ?, 2)", wideIds(1<<33))
+	storage.Close()
+
+	_, err := New(Configure().Path(p))
+	Expect(err).To.Equal(ErrIdTooLarge)
+}
+
+// ids as they're written by an ids64 build
+func wideIds(ids ...uint64) []byte {
+	payload := make([]byte, 8*len(ids))
+	for i, id := range ids {
+		encoder.PutUint64(payload[i*8:], id)
+	}
+	return payload
+}
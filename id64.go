@@ -0,0 +1,91 @@
+//go:build ids64
+// +build ids64
+
+package indexes
+
+import (
+	"sort"
+	"sync"
+)
+
+// Ids are 64 bits
+type Id uint64
+
+// The number of bytes an id takes in a payload
+const IdSize = 8
+
+// the high bits of an id, which group ids in a BitmapSet
+type bitmapKey uint64
+
+func readId(b []byte) Id {
+	return Id(encoder.Uint64(b))
+}
+
+func putId(b []byte, id Id) {
+	encoder.PutUint64(b, uint64(id))
+}
+
+func newFixedSet(ids []Id) Set {
+	sorted := make([]Id, len(ids))
+	copy(sorted, ids)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	unique := sorted[:0]
+	for i, id := range sorted {
+		if i == 0 || id != sorted[i-1] {
+			unique = append(unique, id)
+		}
+	}
+	return &FixedSet{ids: unique}
+}
+
+// intset only holds 32 bit values, so 64 bit ids are kept sorted and
+// searched instead
+type FixedSet struct {
+	sync.RWMutex
+	ids []Id
+}
+
+func (s *FixedSet) Len() int {
+	return len(s.ids)
+}
+
+func (s *FixedSet) Exists(value Id) bool {
+	i := s.search(value)
+	return i < len(s.ids) && s.ids[i] == value
+}
+
+func (s *FixedSet) Each(desc bool, fn func(Id) bool) {
+	if desc {
+		for i := len(s.ids) - 1; i > -1; i-- {
+			if fn(s.ids[i]) == false {
+				return
+			}
+		}
+		return
+	}
+	for _, id := range s.ids {
+		if fn(id) == false {
+			return
+		}
+	}
+}
+
+func (s *FixedSet) Add(id Id) {
+	i := s.search(id)
+	if i < len(s.ids) && s.ids[i] == id {
+		return
+	}
+	s.ids = append(s.ids, 0)
+	copy(s.ids[i+1:], s.ids[i:])
+	s.ids[i] = id
+}
+
+func (s *FixedSet) Remove(id Id) {
+	if i := s.search(id); i < len(s.ids) && s.ids[i] == id {
+		s.ids = append(s.ids[:i], s.ids[i+1:]...)
+	}
+}
+
+func (s *FixedSet) search(id Id) int {
+	return sort.Search(len(s.ids), func(i int) bool { return s.ids[i] >= id })
+}
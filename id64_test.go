@@ -0,0 +1,74 @@
+//go:build ids64
+// +build ids64
+
+package indexes
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "github.com/karlseguin/expect"
+)
+
+func (_ DatabaseTests) ResizesIdsWrittenWithADifferentSize() {
+	dir, _ := ioutil.TempDir("", "indexes")
+	defer os.RemoveAll(dir)
+	p := path.Join(dir, "narrow.db")
+
+	storage, _ := newSqliteStorage(p)
+	storage.Exec("update settings set value = 4 where key = 'id_size'")
+	storage.Exec("insert into indexes (id, payload, type) values ('odd', ?, 2), ('points', ?, 4), ('even', ?, 2)",
+		narrowIds(1, 3), append(narrowIds(2), 0, 0, 0, 0, 0, 0, 0xf8, 0x3f), narrowIds(2))
+	storage.Exec("insert into deltas (id, type, added, removed) values ('even', 2, ?, ?), ('points', 4, ?, ?)",
+		narrowIds(4, 6), narrowIds(2), append(narrowIds(3), 0, 0, 0, 0, 0, 0, 0, 0x40), narrowIds())
+	storage.Close()
+
+	db, err := New(Configure().Path(p))
+	Expect(err).To.Equal(nil)
+	defer db.Close()
+	set := db.GetSet("odd")
+	Expect(set.Len(), set.Exists(1), set.Exists(3)).To.Equal(2, true, true)
+	set = db.GetSet("even")
+	Expect(set.Len(), set.Exists(4), set.Exists(6)).To.Equal(2, true, true)
+	score, _ := db.GetScoredList("points").Score(2)
+	Expect(score).To.Equal(1.5)
+	score, _ = db.GetScoredList("points").Score(3)
+	Expect(score).To.Equal(2.0)
+
+	size := 0
+	db.storage.(*SqliteStorage).QueryRow("select value from settings where key = 'id_size'").Scan(&size)
+	Expect(size).To.Equal(IdSize)
+}
+
+func (_ DatabaseTests) PersistsIdsWiderThan32Bits() {
+	dir, _ := ioutil.TempDir("", "indexes")
+	defer os.RemoveAll(dir)
+	c := Configure().Path(path.Join(dir, "wide.db"))
+	db, _ := New(c)
+	defer db.Close()
+
+	wide := Id(1) << 40
+	updater := db.Update()
+	updater.SetUpdate("odd", wide+1)
+	updater.ScoreUpdate("points", wide+1, 2)
+	updater.IdsUpdate("1w", wide+1)
+	Expect(updater.Commit()).To.Equal(nil)
+
+	loaded, _ := New(c)
+	defer loaded.Close()
+	Expect(loaded.GetSet("odd").Exists(wide+1), loaded.GetSet("odd").Exists(1)).To.Equal(true, false)
+	id, _ := loaded.GetMapping("1w")
+	Expect(id).To.Equal(wide + 1)
+	result, _ := loaded.Query().Sort("points").Execute()
+	assertResult(result, wide+1)
+}
+
+// ids as they're written by a 32 bit build
+func narrowIds(ids ...uint32) []byte {
+	payload := make([]byte, 4*len(ids))
+	for i, id := range ids {
+		encoder.PutUint32(payload[i*4:], id)
+	}
+	return payload
+}
@@ -0,0 +1,68 @@
+package indexes
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The first version of the id map was a series of key length (1 byte), key
+// and id, which can't hold keys longer than 255 bytes. The current version
+// starts with idMapHeader and uses a varint for the key length. The first
+// version would only start with the header if its first key was empty.
+var (
+	idMapHeader     = []byte{0, 2}
+	ErrInvalidIdMap = errors.New("invalid ids payload")
+)
+
+func extractIdMap(payload []byte) (map[string]Id, error) {
+	return extractSizedIdMap(payload, IdSize)
+}
+
+// Reads an id map whose ids are size bytes, which, when migrating, isn't
+// necessarily IdSize
+func extractSizedIdMap(payload []byte, size int) (map[string]Id, error) {
+	ids := make(map[string]Id)
+	current := len(payload) >= len(idMapHeader) && payload[0] == idMapHeader[0] && payload[1] == idMapHeader[1]
+	if current {
+		payload = payload[len(idMapHeader):]
+	}
+	for len(payload) > 0 {
+		var l, n int
+		if current {
+			length, read := binary.Uvarint(payload)
+			if read <= 0 || length > uint64(len(payload)) {
+				return nil, ErrInvalidIdMap
+			}
+			l, n = int(length), read
+		} else {
+			l, n = int(payload[0]), 1
+		}
+		if len(payload) < n+l+size {
+			return nil, ErrInvalidIdMap
+		}
+		payload = payload[n:]
+		key := string(payload[:l])
+		payload = payload[l:]
+		id, err := readSizedId(payload, size)
+		if err != nil {
+			return nil, err
+		}
+		ids[key] = id
+		payload = payload[size:]
+	}
+	return ids, nil
+}
+
+// Encodes the ids in the current version
+func encodeIdMap(ids map[string]Id) []byte {
+	buffer := append([]byte(nil), idMapHeader...)
+	scratch := make([]byte, binary.MaxVarintLen64)
+	for key, id := range ids {
+		n := binary.PutUvarint(scratch, uint64(len(key)))
+		buffer = append(buffer, scratch[:n]...)
+		buffer = append(buffer, key...)
+		putId(scratch, id)
+		buffer = append(buffer, scratch[:IdSize]...)
+	}
+	return buffer
+}
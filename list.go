@@ -10,8 +10,9 @@ type List interface {
 
 type RankedList struct {
 	sync.RWMutex
-	ids  []Id
-	rank map[Id]Id
+	ids     []Id
+	rank    map[Id]Id
+	version uint64
 }
 
 func NewList(ids []Id) List {
@@ -21,8 +22,9 @@ func NewList(ids []Id) List {
 		rank[ids[i]] = Id(i)
 	}
 	return &RankedList{
-		ids:  ids,
-		rank: rank,
+		ids:     ids,
+		rank:    rank,
+		version: nextListVersion(),
 	}
 }
 
@@ -46,6 +48,26 @@ func (l *RankedList) Each(desc bool, fn func(id Id) bool) {
 	}
 }
 
+// Like Each, but starting at the id with the given rank
+func (l *RankedList) EachFrom(rank int, desc bool, fn func(id Id) bool) {
+	if desc {
+		if rank >= len(l.ids) {
+			rank = len(l.ids) - 1
+		}
+		for i := rank; i > -1; i-- {
+			if fn(l.ids[i]) == false {
+				return
+			}
+		}
+		return
+	}
+	for i := rank; i < len(l.ids); i++ {
+		if fn(l.ids[i]) == false {
+			return
+		}
+	}
+}
+
 func (s *RankedList) Around(target Id, fn func(Id) bool) {
 	l := Id(len(s.ids))
 	index := s.rank[target]
@@ -87,8 +109,17 @@ func (l *RankedList) CanRank() bool {
 	return true
 }
 
+func (l *RankedList) Version() uint64 {
+	return l.version
+}
+
 type SimpleList []Id
 
+// Has no lock, and can't be compared with other sets
+func (s SimpleList) viewOf() []Set {
+	return nil
+}
+
 func (s SimpleList) Lock() {
 	// too simple!
 }
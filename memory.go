@@ -0,0 +1,476 @@
+package indexes
+
+import (
+	"strings"
+	"sync"
+)
+
+// An in-memory storage. Useful for tests and for ephemeral databases which
+// don't need to be persisted. Several databases can share one: like sqlite,
+// each reads the changes from its own position, and a change is discarded
+// once all of them have read it.
+type MemoryStorage struct {
+	sync.RWMutex
+	indexes map[string]memoryIndex
+	ids     map[string]Id
+	// the changes which some reader hasn't read yet, oldest first. The first
+	// one's seq is offset+1.
+	changes []memoryChange
+	offset  int64
+	readers map[*memoryReader]struct{}
+	// the reader of Changes called on the storage itself, rather than through a
+	// database
+	own *memoryReader
+}
+
+// the type of an id mapping's change is IdsIndex
+type memoryChange struct {
+	id  string
+	tpe int
+}
+
+// A database's reader of a memory storage, which may be shared by several.
+// Everything but reading changes goes to the storage the database was
+// configured with, which is, or wraps, the memory storage.
+type memoryReader struct {
+	Storage
+	memory *MemoryStorage
+	seq    int64
+}
+
+func (r *memoryReader) Changes(f func(change *Change)) error {
+	return r.memory.changesOf(r, f)
+}
+
+// the changes this reader hasn't read no longer need to be kept for it
+func (r *memoryReader) Close() error {
+	s := r.memory
+	s.Lock()
+	delete(s.readers, r)
+	s.discard()
+	s.Unlock()
+	return r.Storage.Close()
+}
+
+// Storages which are, or wrap, a memory storage
+type memoryBacked interface {
+	memory() *MemoryStorage
+}
+
+func (s *MemoryStorage) memory() *MemoryStorage {
+	return s
+}
+
+// Adds a reader whose changes start after the latest change
+func (s *MemoryStorage) reader(storage Storage) *memoryReader {
+	s.Lock()
+	defer s.Unlock()
+	r := &memoryReader{Storage: storage, memory: s, seq: s.offset + int64(len(s.changes))}
+	s.readers[r] = struct{}{}
+	return r
+}
+
+// like sqlite, indexes of every type share one namespace. An index's deltas
+// are kept until its payload is replaced.
+type memoryIndex struct {
+	tpe     int
+	payload []byte
+	deltas  []storedDelta
+}
+
+// the index's ids with its deltas merged in
+func (index memoryIndex) ids() []Id {
+	return mergeDeltas(extractIdsFromIndex(index.payload), index.deltas)
+}
+
+// the index's payload with its deltas merged in
+func (index memoryIndex) merged() []byte {
+	return mergePayload(index.tpe, index.payload, index.deltas)
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		indexes: make(map[string]memoryIndex),
+		ids:     make(map[string]Id),
+		readers: make(map[*memoryReader]struct{}),
+	}
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+func (s *MemoryStorage) ListCount() uint32 {
+	return s.count(ListIndex)
+}
+
+func (s *MemoryStorage) SetCount() uint32 {
+	return s.count(SetIndex)
+}
+
+func (s *MemoryStorage) EachId(f func(external string, id Id)) error {
+	s.RLock()
+	defer s.RUnlock()
+	for external, id := range s.ids {
+		f(external, id)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) LoadSequence() (Id, []Id, error) {
+	s.RLock()
+	defer s.RUnlock()
+	index, exists := s.indexes[sequenceId]
+	if exists == false || index.tpe != SequenceIndex {
+		return 0, nil, nil
+	}
+	next, freed := extractSequence(index.payload)
+	return next, freed, nil
+}
+
+func (s *MemoryStorage) EachSet(f func(name string, ids []Id)) error {
+	s.RLock()
+	defer s.RUnlock()
+	for name, index := range s.indexes {
+		if index.tpe == SetIndex {
+			f(name, index.ids())
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) EachList(f func(name string, ids []Id)) error {
+	s.each(ListIndex, func(name string, payload []byte) {
+		f(name, extractIdsFromIndex(payload))
+	})
+	return nil
+}
+
+func (s *MemoryStorage) EachScored(f func(name string, ids []Id, scores []float64)) error {
+	s.each(ScoredIndex, func(name string, payload []byte) {
+		ids, scores := extractScoresFromIndex(payload)
+		f(name, ids, scores)
+	})
+	return nil
+}
+
+func (s *MemoryStorage) EachNumeric(f func(name string, ids []Id, values []float64)) error {
+	s.each(NumericIndex, func(name string, payload []byte) {
+		ids, values := extractScoresFromIndex(payload)
+		f(strings.TrimPrefix(name, numericPrefix), ids, values)
+	})
+	return nil
+}
+
+// Calls f once for every index and id mapping written since the last call
+func (s *MemoryStorage) Changes(f func(change *Change)) error {
+	s.Lock()
+	if s.own == nil {
+		s.own = &memoryReader{Storage: s, memory: s, seq: s.offset}
+		s.readers[s.own] = struct{}{}
+	}
+	s.Unlock()
+	return s.changesOf(s.own, f)
+}
+
+// Calls f once for every index and id mapping written since the reader last
+// read its changes, with its current payload (or as removed)
+func (s *MemoryStorage) changesOf(r *memoryReader, f func(change *Change)) error {
+	s.Lock()
+	defer s.Unlock()
+	indexes, ids := make(map[string]int), make(map[string]struct{})
+	for _, c := range s.changes[r.seq-s.offset:] {
+		if c.tpe == IdsIndex {
+			ids[c.id] = struct{}{}
+		} else {
+			indexes[c.id] = c.tpe
+		}
+	}
+	r.seq = s.offset + int64(len(s.changes))
+	s.discard()
+
+	change := new(Change)
+	for id, tpe := range indexes {
+		index, exists := s.indexes[id]
+		change.Id, change.Type, change.Removed, change.Payload = id, tpe, !exists, nil
+		if exists {
+			change.Type, change.Payload = index.tpe, index.merged()
+		}
+		if change.Type == NumericIndex {
+			change.Id = strings.TrimPrefix(id, numericPrefix)
+		}
+		f(change)
+	}
+
+	change.Type = IdsIndex
+	for external := range ids {
+		id, exists := s.ids[external]
+		change.Id, change.Removed, change.Payload = external, !exists, nil
+		if exists {
+			change.Payload = make([]byte, IdSize)
+			putId(change.Payload, id)
+		}
+		f(change)
+	}
+	return nil
+}
+
+// must be called under lock. Records a change for the readers to read, if
+// there are any: a reader added later starts after it anyway.
+func (s *MemoryStorage) record(id string, tpe int) {
+	if len(s.readers) > 0 {
+		s.changes = append(s.changes, memoryChange{id, tpe})
+	}
+}
+
+// must be called under lock. Discards the changes every reader has read.
+func (s *MemoryStorage) discard() {
+	read := s.offset + int64(len(s.changes))
+	for r := range s.readers {
+		if r.seq < read {
+			read = r.seq
+		}
+	}
+	if n := int(read - s.offset); n > 0 {
+		s.changes = append(s.changes[:0:0], s.changes[n:]...)
+		s.offset = read
+	}
+}
+
+func (s *MemoryStorage) UpsertSet(id string, payload []byte) ([]Id, error) {
+	s.upsert(id, SetIndex, payload)
+	return extractIdsFromIndex(payload), nil
+}
+
+func (s *MemoryStorage) UpsertList(id string, payload []byte) ([]Id, error) {
+	s.upsert(id, ListIndex, payload)
+	return extractIdsFromIndex(payload), nil
+}
+
+func (s *MemoryStorage) RemoveSet(id string) error {
+	s.Lock()
+	if index, exists := s.indexes[id]; exists {
+		delete(s.indexes, id)
+		s.record(id, index.tpe)
+	}
+	s.Unlock()
+	return nil
+}
+
+func (s *MemoryStorage) RemoveList(id string) error {
+	return s.RemoveSet(id)
+}
+
+func (s *MemoryStorage) UpdateIds(payload []byte) (map[string]Id, error) {
+	ids, err := extractIdMap(payload)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	for external := range s.ids {
+		s.removeId(external)
+	}
+	for external, id := range ids {
+		s.putId(external, id)
+	}
+	s.Unlock()
+	return ids, nil
+}
+
+func (s *MemoryStorage) Begin() (Batch, error) {
+	return &memoryBatch{storage: s}, nil
+}
+
+func (s *MemoryStorage) count(tpe int) uint32 {
+	s.RLock()
+	defer s.RUnlock()
+	count := uint32(0)
+	for _, index := range s.indexes {
+		if index.tpe == tpe {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *MemoryStorage) each(tpe int, f func(name string, payload []byte)) {
+	s.RLock()
+	defer s.RUnlock()
+	for name, index := range s.indexes {
+		if index.tpe == tpe {
+			f(name, index.merged())
+		}
+	}
+}
+
+func (s *MemoryStorage) upsert(id string, tpe int, payload []byte) {
+	s.Lock()
+	s.put(id, tpe, copyPayload(payload))
+	s.Unlock()
+}
+
+// must be called under lock
+func (s *MemoryStorage) put(id string, tpe int, payload []byte) {
+	s.indexes[id] = memoryIndex{tpe, payload, nil}
+	s.record(id, tpe)
+}
+
+// must be called under lock
+func (s *MemoryStorage) putDelta(id string, tpe int, delta storedDelta) {
+	index, exists := s.indexes[id]
+	if exists == false {
+		index.tpe = tpe
+	}
+	index.deltas = append(index.deltas, delta)
+	s.indexes[id] = index
+	s.record(id, index.tpe)
+}
+
+// must be called under lock
+func (s *MemoryStorage) putId(external string, id Id) {
+	s.ids[external] = id
+	s.record(external, IdsIndex)
+}
+
+// must be called under lock
+func (s *MemoryStorage) removeId(external string) {
+	delete(s.ids, external)
+	s.record(external, IdsIndex)
+}
+
+// callers are free to reuse their buffers
+func copyPayload(payload []byte) []byte {
+	c := make([]byte, len(payload))
+	copy(c, payload)
+	return c
+}
+
+// Changes are buffered and applied, under lock, on commit
+type memoryBatch struct {
+	storage *MemoryStorage
+	puts    []memoryPut
+	deltas  []memoryDelta
+	ids     map[string]Id
+	removed map[string]struct{}
+}
+
+type memoryPut struct {
+	id string
+	memoryIndex
+}
+
+type memoryDelta struct {
+	id  string
+	tpe int
+	storedDelta
+}
+
+func (b *memoryBatch) PutSet(id string, payload []byte) error {
+	return b.put(id, SetIndex, payload)
+}
+
+func (b *memoryBatch) PutSetDelta(id string, added []byte, removed []byte) error {
+	return b.putDelta(id, SetIndex, added, removed)
+}
+
+func (b *memoryBatch) SetDeltas(id string) (int, bool, error) {
+	return b.countDeltas(id, SetIndex)
+}
+
+func (b *memoryBatch) PutList(id string, payload []byte) error {
+	return b.put(id, ListIndex, payload)
+}
+
+func (b *memoryBatch) PutId(external string, id Id) error {
+	if b.ids == nil {
+		b.ids = make(map[string]Id)
+	}
+	delete(b.removed, external)
+	b.ids[external] = id
+	return nil
+}
+
+func (b *memoryBatch) RemoveId(external string) error {
+	if b.removed == nil {
+		b.removed = make(map[string]struct{})
+	}
+	delete(b.ids, external)
+	b.removed[external] = struct{}{}
+	return nil
+}
+
+func (b *memoryBatch) PutSequence(payload []byte) error {
+	return b.put(sequenceId, SequenceIndex, payload)
+}
+
+func (b *memoryBatch) PutScored(id string, payload []byte) error {
+	return b.put(id, ScoredIndex, payload)
+}
+
+func (b *memoryBatch) PutScoredDelta(id string, updated []byte, removed []byte) error {
+	return b.putDelta(id, ScoredIndex, updated, removed)
+}
+
+func (b *memoryBatch) ScoredDeltas(id string) (int, bool, error) {
+	return b.countDeltas(id, ScoredIndex)
+}
+
+func (b *memoryBatch) PutNumeric(id string, payload []byte) error {
+	return b.put(numericId(id), NumericIndex, payload)
+}
+
+func (b *memoryBatch) PutNumericDelta(id string, updated []byte, removed []byte) error {
+	return b.putDelta(numericId(id), NumericIndex, updated, removed)
+}
+
+func (b *memoryBatch) NumericDeltas(id string) (int, bool, error) {
+	return b.countDeltas(numericId(id), NumericIndex)
+}
+
+func (b *memoryBatch) Commit() error {
+	s := b.storage
+	s.Lock()
+	defer s.Unlock()
+	for _, put := range b.puts {
+		s.put(put.id, put.tpe, put.payload)
+	}
+	for _, delta := range b.deltas {
+		s.putDelta(delta.id, delta.tpe, delta.storedDelta)
+	}
+	for external, id := range b.ids {
+		s.putId(external, id)
+	}
+	for external := range b.removed {
+		s.removeId(external)
+	}
+	b.puts, b.deltas, b.ids, b.removed = nil, nil, nil, nil
+	return nil
+}
+
+func (b *memoryBatch) Rollback() error {
+	b.puts, b.deltas, b.ids, b.removed = nil, nil, nil, nil
+	return nil
+}
+
+func (b *memoryBatch) put(id string, tpe int, payload []byte) error {
+	b.puts = append(b.puts, memoryPut{id, memoryIndex{tpe, copyPayload(payload), nil}})
+	return nil
+}
+
+func (b *memoryBatch) putDelta(id string, tpe int, added []byte, removed []byte) error {
+	b.deltas = append(b.deltas, memoryDelta{id, tpe, storedDelta{copyPayload(added), copyPayload(removed)}})
+	return nil
+}
+
+// reads the committed storage, as a memory batch only sees its own writes
+// once it's committed
+func (b *memoryBatch) countDeltas(id string, tpe int) (int, bool, error) {
+	s := b.storage
+	s.RLock()
+	defer s.RUnlock()
+	index, exists := s.indexes[id]
+	if exists == false || index.tpe != tpe {
+		return 0, false, nil
+	}
+	return len(index.deltas), true, nil
+}
@@ -0,0 +1,136 @@
+package indexes
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// How a query finds its matches
+type Strategy string
+
+const (
+	// nothing can match (an empty sort or set, or a zero limit)
+	EmptyStrategy Strategy = "empty"
+	// walk the sort in order, checking every set for each id
+	StreamStrategy Strategy = "stream"
+	// walk the smallest set, then order its matches by their rank in the sort
+	SetStrategy Strategy = "set"
+	// intersect the (bitmap) sets up front, then walk the sort checking only
+	// the intersection
+	IntersectStrategy Strategy = "intersect"
+	// intersect the (bitmap) sets up front, then order the intersection by
+	// rank, like SetStrategy
+	IntersectSetStrategy Strategy = "intersect-set"
+	// score every candidate by its rank in each blended list, keeping the best
+	BlendStrategy Strategy = "blend"
+)
+
+// The plan a query was executed with
+type Plan struct {
+	Strategy Strategy
+	// The name of the sort or set which was walked; empty when it was added
+	// without a name (AndSet, SortList, ...) or is an intersection
+	Driver string
+	// The estimated and actual number of ids which had to be looked at
+	Estimated int
+	Scanned   int
+}
+
+func (p *Plan) String() string {
+	return fmt.Sprintf("%s driven by %q, scanned %d (estimated %d)", p.Strategy, p.Driver, p.Scanned, p.Estimated)
+}
+
+// Estimates the number of ids each possible strategy has to look at, and how
+// many set lookups that costs, and picks the cheapest. l is the number of
+// sets, which are sorted smallest first.
+func (q *Query) plan(l int) Strategy {
+	n := q.sort.Len()
+	sets := q.sets.s[:l]
+	checks := l + q.not.l
+
+	// assume the sets are independent
+	selectivity := 1.0
+	for _, set := range sets {
+		sl := set.Len()
+		if sl < n {
+			selectivity *= float64(sl) / float64(n)
+		}
+	}
+
+	scan := q.streamScan(selectivity)
+	strategy, estimated, cost := StreamStrategy, scan, scan*checks
+	driver := q.sortName
+
+	smallest := sets[0].Len()
+	if smallest < SmallSetTreshold && q.canSetExecute() {
+		if c := setCost(smallest, checks); c <= cost {
+			strategy, estimated, cost = SetStrategy, smallest, c
+			driver = q.sets.n[0]
+		}
+	}
+
+	if l > 1 && q.allBitmaps() {
+		c := q.intersectCost() + scan*(1+q.not.l)
+		if c < cost {
+			strategy, estimated, cost = IntersectStrategy, scan, c
+			driver = q.sortName
+		}
+	}
+
+	q.explained(strategy, driver, estimated)
+	return strategy
+}
+
+// The intersection only ever shrinks, so intersecting the smallest set with
+// each of the others bounds the work of intersecting them all. Sets which
+// share few containers, say a handful of ids and millions, are cheap.
+func (q *Query) intersectCost() int {
+	smallest, cost := q.sets.s[0].(*BitmapSet), 0
+	for i := 1; i < q.sets.l; i++ {
+		cost += andCost(smallest, q.sets.s[i].(*BitmapSet))
+	}
+	return cost
+}
+
+// Called once the intersection of the sets is known. Returns true if
+// the intersection should drive the query
+func (q *Query) replan(matches int) bool {
+	if matches >= SmallSetTreshold || q.canSetExecute() == false {
+		return false
+	}
+	checks := 1 + q.not.l
+	scan := q.streamScan(float64(matches) / float64(q.sort.Len()))
+	if setCost(matches, checks) > scan*checks {
+		return false
+	}
+	q.explained(IntersectSetStrategy, "", matches)
+	return true
+}
+
+// The number of ids of the sort we expect to walk given the fraction of
+// them which match. Streaming stops once it has enough matches, unless it's
+// counting.
+func (q *Query) streamScan(selectivity float64) int {
+	n := q.sort.Len()
+	wanted := q.offset + q.limit
+	if q.count || len(q.facets) > 0 || q.around != 0 {
+		wanted = n
+	}
+	if expected := selectivity * float64(n); expected > float64(wanted) {
+		return int(float64(wanted) / selectivity)
+	}
+	return n
+}
+
+// every id of the driving set is checked, ranked and then sorted
+func setCost(n int, checks int) int {
+	return n*checks + n*bits.Len(uint(n))
+}
+
+func (q *Query) explained(strategy Strategy, driver string, estimated int) {
+	if plan := q.explain; plan != nil {
+		plan.Strategy = strategy
+		plan.Driver = driver
+		plan.Estimated = estimated
+	}
+}
@@ -0,0 +1,258 @@
+package indexes
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNoQueryAvailable = errors.New("no query available")
+)
+
+// Reported when a query has been checked out for longer than the configured
+// threshold. This almost always means Release() wasn't called on a result.
+type Leak struct {
+	// How long the query had been checked out for when it was reported
+	Duration time.Duration
+	// The stack of the goroutine which checked out the query
+	Stack []byte
+}
+
+// A snapshot of the query pool's utilisation
+type QueryPoolStats struct {
+	Min   int
+	Max   int
+	Size  int
+	InUse int
+}
+
+// The pool starts with min queries and grows, one query at a time, up to max
+// when every query is in use. Queries which went unused for an entire idle
+// period are discarded, down to min.
+type QueryPool struct {
+	sync.Mutex
+	db         *Database
+	maxSets    int
+	maxResults int
+	min        int
+	max        int
+	idle       time.Duration
+	lowWater   int32
+	queries    chan *Query
+	all        []*Query
+	threshold  time.Duration
+	report     func(leak *Leak)
+	stop       chan struct{}
+}
+
+func NewQueryPool(db *Database, c *Configuration) *QueryPool {
+	pool := &QueryPool{
+		db:         db,
+		maxSets:    c.maxSets,
+		maxResults: c.maxResults,
+		min:        c.minQueries,
+		max:        c.maxQueries,
+		idle:       c.queryIdle,
+		threshold:  c.leakThreshold,
+		report:     c.leakReport,
+		queries:    make(chan *Query, c.maxQueries),
+		all:        make([]*Query, 0, c.maxQueries),
+	}
+	for i := 0; i < pool.min; i++ {
+		pool.queries <- pool.create()
+	}
+	pool.lowWater = int32(pool.min)
+
+	if pool.report != nil || pool.max > pool.min {
+		pool.stop = make(chan struct{})
+		go pool.maintain()
+	}
+	return pool
+}
+
+// Blocks until a query is available
+func (p *QueryPool) Checkout() *Query {
+	if query := p.available(); query != nil {
+		return query
+	}
+	return p.checkout(<-p.queries)
+}
+
+// Blocks until a query is available or the context is done
+func (p *QueryPool) CheckoutContext(ctx context.Context) (*Query, error) {
+	if query := p.available(); query != nil {
+		return query, nil
+	}
+	select {
+	case query := <-p.queries:
+		return p.checkout(query), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Returns ErrNoQueryAvailable rather than blocking
+func (p *QueryPool) TryCheckout() (*Query, error) {
+	if query := p.available(); query != nil {
+		return query, nil
+	}
+	return nil, ErrNoQueryAvailable
+}
+
+func (p *QueryPool) Stats() QueryPoolStats {
+	p.Lock()
+	size := len(p.all)
+	p.Unlock()
+	return QueryPoolStats{
+		Min:   p.min,
+		Max:   p.max,
+		Size:  size,
+		InUse: size - len(p.queries),
+	}
+}
+
+// Returns an idle query, growing the pool if there isn't one. Returns nil
+// when the pool is at its maximum size and every query is in use.
+func (p *QueryPool) available() *Query {
+	select {
+	case query := <-p.queries:
+		return p.checkout(query)
+	default:
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	if len(p.all) == p.max {
+		return nil
+	}
+	return p.checkout(p.create())
+}
+
+// must be called under lock (or before the pool is shared)
+func (p *QueryPool) create() *Query {
+	result := newResult(p.maxSets, p.maxResults)
+	query := &Query{
+		db:      p.db,
+		limit:   50,
+		result:  result,
+		sets:    NewSets(p.maxSets),
+		not:     NewSets(p.maxSets),
+		scratch: new(BitmapSet),
+	}
+	result.query = query
+	p.all = append(p.all, query)
+	return query
+}
+
+func (p *QueryPool) checkout(query *Query) *Query {
+	// track the fewest idle queries seen during this idle period
+	for {
+		low, available := atomic.LoadInt32(&p.lowWater), int32(len(p.queries))
+		if available >= low || atomic.CompareAndSwapInt32(&p.lowWater, low, available) {
+			break
+		}
+	}
+	if p.report != nil {
+		buf := make([]byte, 2048)
+		query.stack.Store(buf[:runtime.Stack(buf, false)])
+		atomic.StoreInt32(&query.leaked, 0)
+		atomic.StoreInt64(&query.checkedOut, time.Now().UnixNano())
+	}
+	return query
+}
+
+func (p *QueryPool) checkin(query *Query) {
+	if p.report != nil {
+		atomic.StoreInt64(&query.checkedOut, 0)
+	}
+	p.queries <- query
+}
+
+// A nil channel is never ready, so whichever of these isn't enabled is
+// simply never selected
+func (p *QueryPool) maintain() {
+	var leaks, shrink <-chan time.Time
+	if p.report != nil {
+		ticker := time.NewTicker(p.threshold / 2)
+		defer ticker.Stop()
+		leaks = ticker.C
+	}
+	if p.max > p.min {
+		ticker := time.NewTicker(p.idle)
+		defer ticker.Stop()
+		shrink = ticker.C
+	}
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-leaks:
+			p.detectLeaks(now)
+		case <-shrink:
+			p.shrink()
+		}
+	}
+}
+
+// Reports, once, each query that has been checked out for longer than the
+// threshold
+func (p *QueryPool) detectLeaks(now time.Time) {
+	var leaks []*Leak
+	p.Lock()
+	for _, query := range p.all {
+		checkedOut := atomic.LoadInt64(&query.checkedOut)
+		if checkedOut == 0 {
+			continue
+		}
+		held := time.Duration(now.UnixNano() - checkedOut)
+		if held > p.threshold && atomic.CompareAndSwapInt32(&query.leaked, 0, 1) {
+			stack, _ := query.stack.Load().([]byte)
+			leaks = append(leaks, &Leak{Duration: held, Stack: stack})
+		}
+	}
+	p.Unlock()
+
+	for _, leak := range leaks {
+		p.report(leak)
+	}
+}
+
+// Queries which stayed idle for the entire period weren't needed; discard
+// them (but never go below min)
+func (p *QueryPool) shrink() {
+	unused := int(atomic.SwapInt32(&p.lowWater, int32(len(p.queries))))
+	p.Lock()
+	defer p.Unlock()
+	for ; unused > 0 && len(p.all) > p.min; unused-- {
+		select {
+		case query := <-p.queries:
+			p.remove(query)
+		default:
+			return
+		}
+	}
+	atomic.StoreInt32(&p.lowWater, int32(len(p.queries)))
+}
+
+// must be called under lock
+func (p *QueryPool) remove(query *Query) {
+	for i, q := range p.all {
+		if q == query {
+			last := len(p.all) - 1
+			p.all[i] = p.all[last]
+			p.all[last] = nil
+			p.all = p.all[:last]
+			return
+		}
+	}
+}
+
+func (p *QueryPool) close() {
+	if p.stop != nil {
+		close(p.stop)
+	}
+}
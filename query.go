@@ -1,61 +1,76 @@
 package indexes
 
-import "sort"
+import (
+	"sort"
+	"strings"
+	"sync/atomic"
+)
 
 var (
-	QueryPoolSize    = 64
 	SmallSetTreshold = 500
 )
 
-type QueryPool chan *Query
-
 type Filter func(id Id) bool
 
-func NewQueryPool(db *Database, maxSets int, maxResults int) QueryPool {
-	pool := make(QueryPool, QueryPoolSize)
-	for i := 0; i < QueryPoolSize; i++ {
-		result := newResult(maxSets, maxResults)
-		query := &Query{
-			db:     db,
-			limit:  50,
-			result: result,
-			sets:   NewSets(maxSets),
-		}
-		result.query = query
-		pool <- query
-	}
-	return pool
-}
-
-func (p QueryPool) Checkout() *Query {
-	return <-p
-}
-
 type Query struct {
-	limit  int
-	around Id
-	offset int
-	sort   List
-	desc   bool
-	sets   *Sets
-	db     *Database
-	result *NormalResult
+	limit      int
+	around     Id
+	offset     int
+	sort       List
+	sortName   string
+	then       []sortKey
+	tied       []Id
+	blend      []blendKey
+	blended    []blended
+	after      cursor
+	afterTie   tieResume
+	resume     bool
+	from       int
+	cursorErr  error
+	scanned    int
+	explain    *Plan
+	desc       bool
+	count      bool
+	countLimit int
+	sets       *Sets
+	not        *Sets
+	scratch    *BitmapSet
+	facets     []Set
+	facetNames []string
+	// the sets read locked by Execute
+	locked     []Set
+	db         *Database
+	result     *NormalResult
+	checkedOut int64
+	leaked     int32
+	// the []byte stack of the checkout, read by the pool's leak detection
+	stack atomic.Value
 }
 
 func (q *Query) Sort(name string) *Query {
 	q.sort = q.db.GetList(name)
+	q.sortName = name
+	return q
+}
+
+// Orders ids which tie on the sort (and on any previous Then) by the named
+// list. Only ids with the same score in a scored list tie; ids missing from
+// the list come last.
+func (q *Query) Then(name string, desc bool) *Query {
+	q.then = append(q.then, sortKey{q.db.GetList(name), desc})
 	return q
 }
 
 func (q *Query) SortAnd(name string) *Query {
 	if q.sort != nil {
-		q.AndSet(q.sort)
+		q.sets.add(q.sortName, q.sort)
 	}
 	return q.Sort(name)
 }
 
 func (q *Query) SortList(list List) *Query {
 	q.sort = list
+	q.sortName = ""
 	return q
 }
 
@@ -71,6 +86,37 @@ func (q *Query) Limit(limit int) *Query {
 	return q
 }
 
+// Count the total number of matches, available via the result's Total().
+// This forces the query to keep scanning once the limit has been reached.
+// Ignored for Around queries.
+func (q *Query) WithCount() *Query {
+	q.count = true
+	return q
+}
+
+// Count the total number of matches, but stop counting (and scanning) once
+// limit matches have been found. Total() will be no greater than limit.
+func (q *Query) CountLimit(limit int) *Query {
+	q.count = true
+	q.countLimit = limit
+	return q
+}
+
+// Count how many of the query's matches are also in each of the sets. The
+// counts are available via the result's Facets(). Like WithCount, this forces
+// the query to keep scanning once the limit has been reached (up to the
+// CountLimit, if one is set).
+func (q *Query) Facets(sets ...string) *Query {
+	for _, name := range sets {
+		q.facetNames = append(q.facetNames, name)
+		q.facets = append(q.facets, q.db.GetSet(name))
+	}
+	for len(q.result.facets) < len(q.facets) {
+		q.result.facets = append(q.result.facets, 0)
+	}
+	return q
+}
+
 func (q *Query) Desc() *Query {
 	q.desc = true
 	return q
@@ -83,7 +129,16 @@ func (q *Query) Around(id Id) *Query {
 
 //apply the set to the result
 func (q *Query) And(set string) *Query {
-	return q.AndSet(q.db.GetSet(set))
+	q.sets.add(set, q.db.GetSet(set))
+	return q
+}
+
+// Limits the results to ids whose numeric attribute is between min and max
+// (inclusive). Like And, the range is used to drive the query when it's the
+// most selective.
+func (q *Query) Range(attr string, min float64, max float64) *Query {
+	q.sets.add(attr, q.db.GetNumeric(attr).Range(min, max))
+	return q
 }
 
 func (q *Query) AndSet(set Set) *Query {
@@ -91,6 +146,32 @@ func (q *Query) AndSet(set Set) *Query {
 	return q
 }
 
+// apply the union of the sets to the result; an id must be in at least one
+// of them. Composes with And like any other set.
+func (q *Query) Or(sets ...string) *Query {
+	union := make([]Set, len(sets))
+	for i, set := range sets {
+		union[i] = q.db.GetSet(set)
+	}
+	q.sets.add(strings.Join(sets, "|"), NewUnionSet(union))
+	return q
+}
+
+func (q *Query) OrSets(sets ...Set) *Query {
+	return q.AndSet(NewUnionSet(sets))
+}
+
+// exclude any id which is in the set from the result. An excluded set is
+// never used to drive the query.
+func (q *Query) Not(set string) *Query {
+	return q.NotSet(q.db.GetSet(set))
+}
+
+func (q *Query) NotSet(set Set) *Query {
+	q.not.Add(set)
+	return q
+}
+
 func (q *Query) HasSort() bool {
 	return q.sort != nil
 }
@@ -98,46 +179,174 @@ func (q *Query) HasSort() bool {
 // Executes the query. After execution, the query object should not be used until
 // Release() is called on the returned result
 func (q *Query) Execute() (Result, error) {
-	if q.limit == 0 {
-		q.result.Release()
-		return EmptyResult, nil
+	if q.cursorErr != nil {
+		result, _ := q.empty()
+		return result, ErrInvalidCursor
+	}
+	// with a limit of 0 there's nothing to return, unless the query is only
+	// being run to count
+	if q.limit == 0 && q.counting() == false {
+		return q.empty()
 	}
 
-	q.sets.RLock()
-	defer q.sets.RUnlock()
+	q.rlock()
+	defer q.runlock()
 	q.sets.Sort()
 
+	if len(q.blend) > 0 {
+		return q.blendExecute()
+	}
+
 	if q.sort == nil {
 		if q.sets.l == 0 {
-			q.result.Release()
-			return EmptyResult, nil
+			return q.empty()
 		}
+		q.sortName = q.sets.n[0]
 		q.sort = q.sets.Shift()
 	}
 
 	if q.sort.Len() == 0 {
-		q.result.Release()
-		return EmptyResult, nil
+		return q.empty()
+	}
+
+	if q.resume = q.resume && q.around == 0 && q.sort.CanRank(); q.resume {
+		q.from = q.resumeFrom()
+		q.resumeTied()
 	}
 
 	l := q.sets.l
 	if l == 0 {
-		return q.execute(noFilter)
+		q.explained(StreamStrategy, q.sortName, q.sort.Len())
+		return q.execute(q.notFilter(noFilter))
+	}
+
+	if q.sets.s[0].Len() == 0 {
+		return q.empty()
+	}
+
+	switch q.plan(l) {
+	case SetStrategy:
+		return q.setExecute(q.sets.s[0], q.notFilter(q.getFilter(l, 1)))
+	case IntersectStrategy:
+		scratch := q.intersect()
+		if scratch.Len() == 0 {
+			return q.empty()
+		}
+		if q.replan(scratch.Len()) {
+			return q.setExecute(scratch, q.notFilter(noFilter))
+		}
+		return q.execute(q.notFilter(scratch.Exists))
+	}
+	return q.execute(q.notFilter(q.getFilter(l, 0)))
+}
+
+// Executes the query, releases the result and returns the plan which was
+// used along with how many ids were scanned
+func (q *Query) Explain() (*Plan, error) {
+	plan := &Plan{Strategy: EmptyStrategy}
+	q.explain = plan
+	result, err := q.Execute()
+	if err != nil {
+		return nil, err
+	}
+	result.Release()
+	return plan, nil
+}
+
+// Read locks every set the query reads, once: read locks aren't reentrant,
+// so taking one a second time, say for a set which is also the sort or a
+// facet, would deadlock against a waiting writer. Views lock the sets they're
+// over. The locks are taken under the database's lockOrder, like a writer
+// which locks several sets, so that the two don't deadlock.
+func (q *Query) rlock() {
+	locked := q.locked[:0]
+	for i := 0; i < q.sets.l; i++ {
+		locked = appendLockable(locked, q.sets.s[i])
+	}
+	for i := 0; i < q.not.l; i++ {
+		locked = appendLockable(locked, q.not.s[i])
+	}
+	for _, facet := range q.facets {
+		locked = appendLockable(locked, facet)
+	}
+	for _, key := range q.then {
+		locked = appendLockable(locked, key.list)
+	}
+	for _, key := range q.blend {
+		locked = appendLockable(locked, key.list)
+	}
+	if q.sort != nil {
+		locked = appendLockable(locked, q.sort)
+	}
+	q.locked = locked
+
+	q.db.lockOrder.RLock()
+	for _, set := range locked {
+		set.RLock()
 	}
+	q.db.lockOrder.RUnlock()
+}
+
+// Releases exactly the locks rlock took, whatever has since been shifted out
+// of the query's sets
+func (q *Query) runlock() {
+	for i, set := range q.locked {
+		set.RUnlock()
+		q.locked[i] = nil
+	}
+	q.locked = q.locked[:0]
+}
+
+func (q *Query) empty() (Result, error) {
+	q.explained(EmptyStrategy, "", 0)
+	result := EmptyResult
+	if len(q.facetNames) > 0 {
+		// the names are reset when the query is released
+		result = &emptyResult{counted: q.count, facets: append([]string(nil), q.facetNames...)}
+	} else if q.count {
+		result = countedEmptyResult
+	}
+	q.result.Release()
+	return result, nil
+}
+
+// whether a set can drive the query, its matches ordered by the sort's rank
+func (q *Query) canSetExecute() bool {
+	return q.sort.CanRank() && q.around == 0
+}
 
-	sl := q.sets.s[0].Len()
-	if sl == 0 {
-		q.result.Release()
-		return EmptyResult, nil
+func (q *Query) allBitmaps() bool {
+	for i := 0; i < q.sets.l; i++ {
+		if _, ok := q.sets.s[i].(*BitmapSet); ok == false {
+			return false
+		}
 	}
+	return true
+}
 
-	q.sort.RLock()
-	defer q.sort.RUnlock()
+// materializes the AND of the sets into the query's scratch bitmap
+func (q *Query) intersect() *BitmapSet {
+	sets := q.sets.s
+	q.scratch.and(sets[0].(*BitmapSet), sets[1].(*BitmapSet))
+	for i := 2; i < q.sets.l && q.scratch.Len() > 0; i++ {
+		q.scratch.and(q.scratch, sets[i].(*BitmapSet))
+	}
+	return q.scratch
+}
 
-	if sl < SmallSetTreshold && q.sort.Len() > 1000 && q.sort.CanRank() && q.around == 0 {
-		return q.setExecute(q.getFilter(l, 1))
+// wraps the filter so that ids in any of the excluded sets are rejected
+func (q *Query) notFilter(filter Filter) Filter {
+	if q.not.l == 0 {
+		return filter
+	}
+	return func(id Id) bool {
+		for i := 0; i < q.not.l; i++ {
+			if q.not.s[i].Exists(id) {
+				return false
+			}
+		}
+		return filter(id)
 	}
-	return q.execute(q.getFilter(l, 0))
 }
 
 func (q *Query) getFilter(count int, start int) Filter {
@@ -211,6 +420,10 @@ func (q *Query) multiSetsFilter(start int) Filter {
 
 //TODO: if len(q.sets) == 0, we could skip directly to the offset....
 func (q *Query) execute(filter func(id Id) bool) (Result, error) {
+	defer q.scannedAll()
+	if q.resume && q.counting() {
+		q.countResumed(filter)
+	}
 	if q.around != 0 {
 		q.limit = 1
 		q.offset = 0
@@ -222,6 +435,14 @@ func (q *Query) execute(filter func(id Id) bool) (Result, error) {
 			}
 			return false
 		})
+	} else if _, ties := q.sort.(scoredList); ties && len(q.then) > 0 {
+		q.eachTied(func(id Id) bool {
+			return q.executeOne(filter, id)
+		})
+	} else if q.resume {
+		q.eachResumed(func(id Id) bool {
+			return q.executeOne(filter, id)
+		})
 	} else {
 		q.sort.Each(q.desc, func(id Id) bool {
 			return q.executeOne(filter, id)
@@ -230,16 +451,101 @@ func (q *Query) execute(filter func(id Id) bool) (Result, error) {
 	return q.result, nil
 }
 
+// Streams the sort, from the resumed position if there's one, collecting ids
+// with the same score and ordering them by the tie-breakers before passing
+// them to fn
+func (q *Query) eachTied(fn func(id Id) bool) {
+	scores := q.sort.(scoredList)
+	each := func(fn func(id Id) bool) {
+		q.sort.Each(q.desc, fn)
+	}
+	if q.resume {
+		each = q.eachResumed
+	}
+	tied, current, stopped := q.tied[:0], 0.0, false
+	each(func(id Id) bool {
+		score, _ := scores.Score(id)
+		if len(tied) > 0 && score != current {
+			if stopped = q.breakTies(tied, fn) == false; stopped {
+				return false
+			}
+			tied = tied[:0]
+		}
+		current = score
+		tied = append(tied, id)
+		return true
+	})
+	if stopped == false && len(tied) > 0 {
+		q.breakTies(tied, fn)
+	}
+	q.tied = tied[:0]
+}
+
+func (q *Query) breakTies(tied []Id, fn func(id Id) bool) bool {
+	sort.SliceStable(tied, func(i, j int) bool {
+		return q.thenLess(tied[i], tied[j])
+	})
+	for _, id := range tied {
+		if q.tiedBefore(id) {
+			continue
+		}
+		if fn(id) == false {
+			return false
+		}
+	}
+	return true
+}
+
+// Orders the runs of ranked ids which have the same score. When the ranks are
+// read in reverse (desc), the runs are ordered in reverse too.
+func (q *Query) sortTies(ranks Ranks) {
+	scores, ok := q.sort.(scoredList)
+	if ok == false || len(q.then) == 0 {
+		return
+	}
+	for start, l := 0, len(ranks); start < l; {
+		score, _ := scores.Score(ranks[start].id)
+		end := start + 1
+		for ; end < l; end++ {
+			if next, _ := scores.Score(ranks[end].id); next != score {
+				break
+			}
+		}
+		if end-start > 1 {
+			run := ranks[start:end]
+			sort.SliceStable(run, func(i, j int) bool {
+				if q.desc {
+					return q.thenLess(run[j].id, run[i].id)
+				}
+				return q.thenLess(run[i].id, run[j].id)
+			})
+		}
+		start = end
+	}
+}
+
+func (q *Query) thenLess(a Id, b Id) bool {
+	for _, key := range q.then {
+		if c := key.compare(a, b); c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
 func (q *Query) executeOne(filter func(id Id) bool, id Id) bool {
+	q.scanned++
 	if filter(id) == false {
 		return true
 	}
+	q.result.total++
+	q.countFacets(id)
 	if q.offset > 0 {
 		q.offset--
 	} else {
 		if q.limit == 0 {
 			q.result.more = true
-			return false
+			return q.counting()
 		}
 		q.result.add(id)
 		q.limit--
@@ -247,21 +553,49 @@ func (q *Query) executeOne(filter func(id Id) bool, id Id) bool {
 	return true
 }
 
-func (q *Query) setExecute(filter Filter) (Result, error) {
-	set := q.sets.s[0]
+// whether we should keep scanning after the limit has been reached
+func (q *Query) counting() bool {
+	if q.count == false && len(q.facets) == 0 {
+		return false
+	}
+	return q.countLimit == 0 || q.result.total < q.countLimit
+}
+
+func (q *Query) countFacets(id Id) {
+	for i, facet := range q.facets {
+		if facet.Exists(id) {
+			q.result.facets[i]++
+		}
+	}
+}
+
+func (q *Query) setExecute(set Set, filter Filter) (Result, error) {
+	defer q.scannedAll()
+	before := 0
 	set.Each(true, func(id Id) bool {
+		q.scanned++
 		if filter(id) == false {
 			return true
 		}
-		if rank, ok := q.sort.Rank(id); ok {
+		rank, ok := q.sort.Rank(id)
+		if ok == false {
+			return true
+		}
+		if (q.resume == false || q.resumed(rank)) && q.tiedBefore(id) == false {
 			q.result.addranked(id, rank)
+		} else {
+			// before the cursor: counted, like an offset, but not returned
+			before++
 		}
+		q.countFacets(id)
 		return true
 	})
 	l := q.result.length
 	q.result.length = 0
+	q.result.total = l + before
 	ranks := q.result.ranked[:l]
 	sort.Sort(ranks)
+	q.sortTies(ranks)
 
 	if q.desc {
 		for i := len(ranks) - q.offset - 1; i > -1; i-- {
@@ -289,13 +623,73 @@ func (q *Query) setExecuteAdd(result *NormalResult, id Id) bool {
 	return true
 }
 
+func (q *Query) scannedAll() {
+	if q.explain != nil {
+		q.explain.Scanned = q.scanned
+	}
+}
+
 // called when the result is released
 func (q *Query) release() {
 	q.sets.reset()
+	q.not.reset()
 	q.sort = nil
+	q.sortName = ""
+	q.then = q.then[:0]
+	q.blend = q.blend[:0]
+	q.resume = false
+	q.afterTie = tieResume{}
+	q.cursorErr = nil
+	q.scanned = 0
+	q.explain = nil
 	q.offset = 0
 	q.around = 0
 	q.limit = 50
 	q.desc = false
-	q.db.queries <- q
+	q.count = false
+	q.countLimit = 0
+	q.facets = q.facets[:0]
+	q.facetNames = q.facetNames[:0]
+	q.db.queries.checkin(q)
+}
+
+// A list which can be used to break ties in the sort
+type sortKey struct {
+	list List
+	desc bool
+}
+
+// Lists which know the score of their ids, which can tie
+type scoredList interface {
+	Score(id Id) (float64, bool)
+}
+
+// Negative when a comes first. Ids missing from the list come last, whatever
+// the direction.
+func (k sortKey) compare(a Id, b Id) int {
+	var less, equal, okA, okB bool
+	if scores, ok := k.list.(scoredList); ok {
+		var sa, sb float64
+		sa, okA = scores.Score(a)
+		sb, okB = scores.Score(b)
+		less, equal = sa < sb, sa == sb
+	} else {
+		var ra, rb int
+		ra, okA = k.list.Rank(a)
+		rb, okB = k.list.Rank(b)
+		less, equal = ra < rb, ra == rb
+	}
+	if okA != okB {
+		if okA {
+			return -1
+		}
+		return 1
+	}
+	if okA == false || equal {
+		return 0
+	}
+	if less == k.desc {
+		return 1
+	}
+	return -1
 }
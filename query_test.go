@@ -182,6 +182,21 @@ func (qt QueryTests) ZeroLimit() {
 	result, _ := qt.db.Query().Sort("recent").Limit(0).Execute()
 	Expect(result.HasMore()).To.Equal(false)
 	Expect(result.Len()).To.Equal(0)
+	Expect(result.Total()).To.Equal(-1)
+}
+
+func (qt QueryTests) ZeroLimitStillCounts() {
+	result, _ := qt.db.Query().Sort("recent").Limit(0).WithCount().Execute()
+	Expect(result.HasMore()).To.Equal(true)
+	Expect(result.Total()).To.Equal(15)
+	Expect(result.Len()).To.Equal(0)
+	result.Release()
+
+	result, _ = qt.db.Query().Sort("large").And("1").And("2").Limit(0).WithCount().Execute()
+	Expect(result.HasMore()).To.Equal(true)
+	Expect(result.Total()).To.Equal(13)
+	Expect(result.Len()).To.Equal(0)
+	result.Release()
 }
 
 func (qt QueryTests) SortAnd() {
@@ -196,7 +211,473 @@ func (qt QueryTests) SortAndInvalid() {
 	Expect(result.Len()).To.Equal(0)
 }
 
-func assertResult(result Result, expected ...uint32) {
+func (qt QueryTests) OrSets() {
+	result, _ := qt.db.Query().Sort("recent").Or("6", "7").Execute()
+	Expect(result.HasMore()).To.Equal(false)
+	assertResult(result, 1, 2, 5, 7, 10)
+}
+
+func (qt QueryTests) OrSetsWithAnd() {
+	result, _ := qt.db.Query().Sort("recent").Or("6", "7").And("1").Limit(3).Execute()
+	Expect(result.HasMore()).To.Equal(true)
+	assertResult(result, 2, 5, 7)
+}
+
+func (qt QueryTests) OrSetsWithoutSort() {
+	result, _ := qt.db.Query().Or("6", "7", "invalid").Execute()
+	Expect(result.HasMore()).To.Equal(false)
+	Expect(result.Len()).To.Equal(5)
+	result.Release()
+}
+
+func (qt QueryTests) SetBasedOrSets() {
+	result, _ := qt.db.Query().Sort("large").Or("6", "7").And("2").Desc().Execute()
+	Expect(result.HasMore()).To.Equal(false)
+	assertResult(result, 10, 7, 5)
+}
+
+func (qt QueryTests) UnionSetYieldsEachIdOnceInOrder() {
+	union := NewUnionSet([]Set{qt.db.GetSet("7"), qt.db.GetSet("6"), qt.db.GetSet("7")})
+	for _, desc := range []bool{false, true} {
+		ids := make([]Id, 0, 5)
+		union.Each(desc, func(id Id) bool {
+			ids = append(ids, id)
+			return true
+		})
+		if desc {
+			Expect(ids).To.Equal([]Id{10, 7, 5, 2, 1})
+		} else {
+			Expect(ids).To.Equal([]Id{1, 2, 5, 7, 10})
+		}
+	}
+}
+
+func (qt QueryTests) OrOfEmptySets() {
+	result, _ := qt.db.Query().Sort("recent").Or("0", "invalid").Execute()
+	Expect(result.HasMore()).To.Equal(false)
+	Expect(result.Len()).To.Equal(0)
+}
+
+func (qt QueryTests) NotSet() {
+	result, _ := qt.db.Query().Sort("recent").Not("1").Execute()
+	Expect(result.HasMore()).To.Equal(false)
+	assertResult(result, 1)
+}
+
+func (qt QueryTests) NotSetWithAnd() {
+	result, _ := qt.db.Query().Sort("recent").And("1").Not("2").Execute()
+	Expect(result.HasMore()).To.Equal(false)
+	assertResult(result, 2)
+}
+
+func (qt QueryTests) NotInvalidSet() {
+	result, _ := qt.db.Query().Sort("recent").Not("invalid").Limit(2).Execute()
+	Expect(result.HasMore()).To.Equal(true)
+	assertResult(result, 1, 2)
+}
+
+func (qt QueryTests) NotWithoutSortOrSets() {
+	result, _ := qt.db.Query().Not("1").Execute()
+	Expect(result.HasMore()).To.Equal(false)
+	Expect(result.Len()).To.Equal(0)
+}
+
+func (qt QueryTests) SetBasedNotSet() {
+	result, _ := qt.db.Query().Sort("large").And("7").Not("6").Not("2").Execute()
+	Expect(result.HasMore()).To.Equal(false)
+	assertResult(result, 2)
+}
+
+func (qt QueryTests) SmallNotSetIsNotUsedAsDriver() {
+	result, _ := qt.db.Query().Sort("large").And("1").Not("6").Limit(2).Execute()
+	Expect(result.HasMore()).To.Equal(true)
+	assertResult(result, 2, 3)
+}
+
+func (qt QueryTests) TotalIsNotCountedByDefault() {
+	result, _ := qt.db.Query().Sort("recent").Limit(2).Execute()
+	Expect(result.Total()).To.Equal(-1)
+	result.Release()
+}
+
+func (qt QueryTests) CountsTotal() {
+	result, _ := qt.db.Query().Sort("recent").And("2").Offset(1).Limit(2).WithCount().Execute()
+	Expect(result.HasMore()).To.Equal(true)
+	Expect(result.Total()).To.Equal(13)
+	assertResult(result, 4, 5)
+}
+
+func (qt QueryTests) CountsTotalWithALimit() {
+	result, _ := qt.db.Query().Sort("recent").Limit(2).CountLimit(5).Execute()
+	Expect(result.HasMore()).To.Equal(true)
+	Expect(result.Total()).To.Equal(5)
+	assertResult(result, 1, 2)
+}
+
+func (qt QueryTests) CountsTotalWithALimitSmallerThanTheResults() {
+	result, _ := qt.db.Query().Sort("recent").Limit(4).CountLimit(2).Execute()
+	Expect(result.Total()).To.Equal(2)
+	assertResult(result, 1, 2, 3, 4)
+}
+
+func (qt QueryTests) SetBasedCountsTotal() {
+	result, _ := qt.db.Query().Sort("large").And("1").And("2").Limit(2).WithCount().Execute()
+	Expect(result.HasMore()).To.Equal(true)
+	Expect(result.Total()).To.Equal(13)
+	assertResult(result, 3, 4)
+}
+
+func (qt QueryTests) EmptyTotal() {
+	result, _ := qt.db.Query().Sort("recent").And("0").WithCount().Execute()
+	Expect(result.Total()).To.Equal(0)
+	result, _ = qt.db.Query().Sort("recent").And("0").Execute()
+	Expect(result.Total()).To.Equal(-1)
+}
+
+func (qt QueryTests) CountsFacets() {
+	result, _ := qt.db.Query().Sort("recent").And("1").Limit(2).Facets("6", "7", "invalid").Execute()
+	Expect(result.HasMore()).To.Equal(true)
+	Expect(result.Total()).To.Equal(-1)
+	facets := result.Facets()
+	Expect(len(facets)).To.Equal(3)
+	Expect(facets["6"]).To.Equal(0)
+	Expect(facets["7"]).To.Equal(4)
+	Expect(facets["invalid"]).To.Equal(0)
+	assertResult(result, 2, 3)
+}
+
+func (qt QueryTests) CountsFacetsWhichAreAlsoFiltered() {
+	result, _ := qt.db.Query().Sort("recent").And("7").Not("6").Facets("7", "6", "7").Execute()
+	facets := result.Facets()
+	Expect(facets["7"]).To.Equal(4)
+	Expect(facets["6"]).To.Equal(0)
+	assertResult(result, 2, 5, 7, 10)
+}
+
+func (qt QueryTests) CountsFacetsOfAnEmptyResult() {
+	result, _ := qt.db.Query().Sort("recent").And("0").Facets("6", "7").Execute()
+	facets := result.Facets()
+	Expect(len(facets)).To.Equal(2)
+	Expect(facets["6"]).To.Equal(0)
+	Expect(facets["7"]).To.Equal(0)
+	result.Release()
+}
+
+func (qt QueryTests) CountsFacetsUpToTheCountLimit() {
+	result, _ := qt.db.Query().Sort("recent").Limit(2).CountLimit(5).Facets("7").Execute()
+	Expect(result.Total()).To.Equal(5)
+	Expect(result.Facets()["7"]).To.Equal(2)
+	assertResult(result, 1, 2)
+}
+
+func (qt QueryTests) SetBasedCountsFacets() {
+	result, _ := qt.db.Query().Sort("large").And("2").Limit(2).Facets("7", "5").Execute()
+	facets := result.Facets()
+	Expect(facets["7"]).To.Equal(3)
+	Expect(facets["5"]).To.Equal(10)
+	assertResult(result, 3, 4)
+}
+
+func (qt QueryTests) FacetsAreResetOnRelease() {
+	result, _ := qt.db.Query().Sort("recent").Facets("7").Execute()
+	Expect(result.Facets()["7"]).To.Equal(4)
+	result.Release()
+	result, _ = qt.db.Query().Sort("recent").Execute()
+	Expect(len(result.Facets())).To.Equal(0)
+	result.Release()
+}
+
+func (qt QueryTests) IntersectsBitmapsUpFront() {
+	a, b := NewBitmapSet(idRange(1, 900)), NewBitmapSet(idRange(300, 1200))
+	result, _ := qt.db.Query().Sort("large").AndSet(a).AndSet(b).Limit(3).WithCount().Execute()
+	Expect(result.HasMore()).To.Equal(true)
+	Expect(result.Total()).To.Equal(601)
+	assertResult(result, 300, 301, 302)
+
+	result, _ = qt.db.Query().Sort("large").AndSet(a).AndSet(b).Not("1").Limit(2).Desc().Execute()
+	Expect(result.HasMore()).To.Equal(true)
+	assertResult(result, 900, 899)
+}
+
+func (qt QueryTests) SmallBitmapIntersectionDrivesTheQuery() {
+	a, b, c := NewBitmapSet(idRange(1, 600)), NewBitmapSet(idRange(550, 1200)), NewBitmapSet(idRange(500, 1100))
+	query := qt.db.Query()
+	result, _ := query.Sort("large").AndSet(a).AndSet(b).AndSet(c).Offset(1).Limit(2).WithCount().Execute()
+	Expect(query.scratch.Len()).To.Equal(51)
+	Expect(query.explain == nil).To.Equal(true)
+	Expect(result.HasMore()).To.Equal(true)
+	Expect(result.Total()).To.Equal(51)
+	assertResult(result, 551, 552)
+}
+
+func (qt QueryTests) SmallBitmapIsntIntersectedWithAHugeOne() {
+	small, huge := NewBitmapSet([]Id{2, 4, 6, 8, 10}), NewBitmapSet(idRange(1, 1000000))
+	plan, _ := qt.db.Query().Sort("large").AndSet(small).AndSet(huge).Explain()
+	Expect(plan.Strategy).To.Equal(SetStrategy)
+	result, _ := qt.db.Query().Sort("large").AndSet(small).AndSet(huge).Execute()
+	assertResult(result, 2, 4, 6, 8, 10)
+}
+
+func (qt QueryTests) EmptyBitmapIntersection() {
+	a, b := NewBitmapSet(idRange(1, 600)), NewBitmapSet(idRange(601, 1200))
+	result, _ := qt.db.Query().Sort("large").AndSet(a).AndSet(b).Execute()
+	Expect(result.HasMore()).To.Equal(false)
+	Expect(result.Len()).To.Equal(0)
+}
+
+func (qt QueryTests) ExplainsAStreamedQuery() {
+	plan, _ := qt.db.Query().Sort("recent").And("1").Limit(2).Explain()
+	Expect(plan.Strategy).To.Equal(StreamStrategy)
+	Expect(plan.Driver).To.Equal("recent")
+	Expect(plan.Estimated).To.Equal(2)
+	Expect(plan.Scanned).To.Equal(4)
+}
+
+func (qt QueryTests) ExplainsASetBasedQuery() {
+	plan, _ := qt.db.Query().Sort("large").And("1").And("2").Limit(2).Explain()
+	Expect(plan.Strategy).To.Equal(SetStrategy)
+	Expect(plan.Driver).To.Equal("2")
+	Expect(plan.Estimated).To.Equal(13)
+	Expect(plan.Scanned).To.Equal(13)
+}
+
+func (qt QueryTests) ExplainsAnEmptyQuery() {
+	plan, _ := qt.db.Query().Sort("recent").And("0").Explain()
+	Expect(plan.Strategy).To.Equal(EmptyStrategy)
+	Expect(plan.Scanned).To.Equal(0)
+}
+
+func (qt QueryTests) ExplainsAnIntersection() {
+	a, b, c := NewBitmapSet(idRange(1, 600)), NewBitmapSet(idRange(550, 1200)), NewBitmapSet(idRange(500, 1100))
+	plan, _ := qt.db.Query().Sort("large").AndSet(a).AndSet(b).AndSet(c).WithCount().Explain()
+	Expect(plan.Strategy).To.Equal(IntersectSetStrategy)
+	Expect(plan.Estimated).To.Equal(51)
+	Expect(plan.Scanned).To.Equal(51)
+
+	plan, _ = qt.db.Query().Sort("large").AndSet(NewBitmapSet(idRange(1, 800))).AndSet(c).WithCount().Explain()
+	Expect(plan.Strategy).To.Equal(IntersectStrategy)
+	Expect(plan.Driver).To.Equal("large")
+	Expect(plan.Scanned).To.Equal(1005)
+}
+
+func (qt QueryTests) ExplainsUsingTheNameOfAShiftedSet() {
+	plan, _ := qt.db.Query().And("1").And("7").Explain()
+	Expect(plan.Strategy).To.Equal(StreamStrategy)
+	Expect(plan.Driver).To.Equal("7")
+	Expect(plan.Scanned).To.Equal(4)
+}
+
+func (_ QueryTests) BreaksTiesWhenStreaming() {
+	db := createRatedDB()
+	defer db.Close()
+	result, _ := db.Query().Sort("rating").Desc().Then("recent", true).Limit(6).Execute()
+	assertResult(result, 5, 1, 3, 4, 2, 6)
+
+	result, _ = db.Query().Sort("rating").Desc().Then("recent", false).Limit(4).Execute()
+	assertResult(result, 1, 5, 3, 2)
+}
+
+func (_ QueryTests) BreaksTiesWhenSetExecuting() {
+	db := createRatedDB()
+	defer db.Close()
+	small := NewSet(idRange(1, 6))
+	query := db.Query().Sort("rating").AndSet(small).Then("recent", true)
+	plan, _ := query.Explain()
+	Expect(plan.Strategy).To.Equal(SetStrategy)
+
+	result, _ := db.Query().Sort("rating").Desc().AndSet(small).Then("recent", true).Execute()
+	assertResult(result, 5, 1, 3, 4, 2, 6)
+	result, _ = db.Query().Sort("rating").AndSet(small).Then("recent", true).Execute()
+	assertResult(result, 6, 4, 2, 5, 1, 3)
+}
+
+func (_ QueryTests) PagesThroughBrokenTies() {
+	db := createRatedDB()
+	defer db.Close()
+	small := NewSet(idRange(1, 6))
+	pages := []func(after string) *Query{
+		func(after string) *Query {
+			return db.Query().Sort("rating").Desc().Then("recent", true).After(after).Limit(2).WithCount()
+		},
+		func(after string) *Query {
+			return db.Query().Sort("rating").Desc().AndSet(small).Then("recent", true).After(after).Limit(2).WithCount()
+		},
+	}
+	for _, page := range pages {
+		cursor, total := "", -1
+		for _, expected := range [][]Id{{5, 1}, {3, 4}, {2, 6}} {
+			result, _ := page(cursor).Execute()
+			if total == -1 {
+				total = result.Total()
+			}
+			Expect(result.Total()).To.Equal(total)
+			cursor = result.Cursor()
+			assertResult(result, expected...)
+		}
+	}
+
+	// 3 isn't recent, so it's last of its run either way
+	cursor := ""
+	for _, expected := range [][]Id{{6, 4}, {2, 5}, {1, 3}} {
+		result, _ := db.Query().Sort("rating").AndSet(small).Then("recent", true).After(cursor).Limit(2).Execute()
+		cursor = result.Cursor()
+		assertResult(result, expected...)
+	}
+}
+
+func (_ QueryTests) BlendsRanks() {
+	storage := NewMemoryStorage()
+	storage.UpsertList("popular", encodeIds([]Id{1, 2, 3, 4}))
+	storage.UpsertList("recent", encodeIds([]Id{4, 3, 5}))
+	db, _ := New(Configure().Storage(storage))
+	defer db.Close()
+	weights := map[string]float64{"popular": 1, "recent": 2}
+
+	result, _ := db.Query().Blend(weights).Execute()
+	assertResult(result, 4, 3, 1, 2, 5)
+
+	result, _ = db.Query().Blend(weights).Offset(1).Limit(2).WithCount().Execute()
+	Expect(result.HasMore()).To.Equal(true)
+	Expect(result.Total()).To.Equal(5)
+	assertResult(result, 3, 1)
+
+	result, _ = db.Query().Blend(weights).Desc().Limit(3).Execute()
+	assertResult(result, 5, 2, 1)
+
+	result, _ = db.Query().Blend(weights).Limit(0).WithCount().Execute()
+	Expect(result.HasMore()).To.Equal(true)
+	Expect(result.Total()).To.Equal(5)
+	Expect(result.Len()).To.Equal(0)
+	result.Release()
+
+	plan, _ := db.Query().Blend(weights).AndSet(NewSet([]Id{1, 2, 5})).Explain()
+	Expect(plan.Strategy).To.Equal(BlendStrategy)
+	Expect(plan.Scanned).To.Equal(3)
+	result, _ = db.Query().Blend(weights).AndSet(NewSet([]Id{1, 2, 5})).Execute()
+	assertResult(result, 1, 2, 5)
+
+	// an id in none of the lists doesn't match, however large the set
+	for _, set := range []Set{NewSet([]Id{1, 2, 3, 4, 5, 9}), NewSet(idRange(1, Id(SmallSetTreshold)+9))} {
+		result, _ = db.Query().Blend(weights).AndSet(set).WithCount().Execute()
+		Expect(result.Total()).To.Equal(5)
+		assertResult(result, 4, 3, 1, 2, 5)
+	}
+}
+
+func (qt QueryTests) ReturnsExternalIds() {
+	result, _ := qt.db.Query().Sort("recent").Limit(3).Execute()
+	Expect(result.ExternalIds()).To.Equal([]string{"2r", "3r", "4r"})
+	result.Release()
+
+	result, _ = qt.db.Query().Sort("other").Execute()
+	Expect(result.ExternalIds()).To.Equal([]string{"11r", "", "13r"})
+	result.Release()
+}
+
+func (qt QueryTests) PagesWithACursor() {
+	result, _ := qt.db.Query().Sort("recent").Limit(3).Execute()
+	cursor := result.Cursor()
+	assertResult(result, 1, 2, 3)
+	result, _ = qt.db.Query().Sort("recent").After(cursor).Limit(3).Execute()
+	assertResult(result, 4, 5, 6)
+
+	result, _ = qt.db.Query().Sort("recent").Desc().Limit(2).Execute()
+	cursor = result.Cursor()
+	assertResult(result, 15, 14)
+	result, _ = qt.db.Query().Sort("recent").Desc().After(cursor).Limit(2).Execute()
+	assertResult(result, 13, 12)
+}
+
+func (qt QueryTests) PagesASetBasedQueryWithACursor() {
+	result, _ := qt.db.Query().Sort("large").And("1").And("2").Limit(2).Execute()
+	cursor := result.Cursor()
+	result.Release()
+	result, _ = qt.db.Query().Sort("large").And("1").And("2").Offset(2).Limit(2).Execute()
+	expected := append([]Id(nil), result.Ids()...)
+	result.Release()
+
+	result, _ = qt.db.Query().Sort("large").And("1").And("2").After(cursor).Limit(2).Execute()
+	Expect(result.Ids()).To.Equal(expected)
+	result.Release()
+}
+
+func (qt QueryTests) CountsTheWholeResultWhenPagingWithACursor() {
+	result, _ := qt.db.Query().Sort("recent").And("2").Limit(2).WithCount().Facets("7").Execute()
+	cursor := result.Cursor()
+	Expect(result.Total(), result.Facets()["7"]).To.Equal(13, 3)
+	result.Release()
+	result, _ = qt.db.Query().Sort("recent").And("2").After(cursor).Limit(2).WithCount().Facets("7").Execute()
+	Expect(result.Total(), result.Facets()["7"]).To.Equal(13, 3)
+	assertResult(result, 5, 6)
+
+	result, _ = qt.db.Query().Sort("large").And("1").And("2").Limit(2).WithCount().Execute()
+	cursor = result.Cursor()
+	result.Release()
+	result, _ = qt.db.Query().Sort("large").And("1").And("2").After(cursor).Limit(2).WithCount().Execute()
+	Expect(result.Total()).To.Equal(13)
+	result.Release()
+}
+
+func (qt QueryTests) RejectsAnInvalidCursor() {
+	_, err := qt.db.Query().Sort("recent").After("not a cursor").Execute()
+	Expect(err).To.Equal(ErrInvalidCursor)
+}
+
+func (_ QueryTests) ResumesACursorAfterTheSortChanges() {
+	db, _ := New(Configure().Storage(NewMemoryStorage()))
+	defer db.Close()
+	updater := db.Update()
+	for id := Id(1); id <= 6; id++ {
+		updater.ScoreUpdate("points", id, float64(id))
+	}
+	updater.Commit()
+
+	result, _ := db.Query().Sort("points").Limit(2).Execute()
+	cursor := result.Cursor()
+	assertResult(result, 1, 2)
+
+	updater = db.Update()
+	updater.ScoreDelete("points", 2)
+	updater.Commit()
+	result, _ = db.Query().Sort("points").After(cursor).Limit(2).Execute()
+	assertResult(result, 3, 4)
+
+	result, _ = db.Query().Sort("points").Limit(2).Execute()
+	cursor = result.Cursor()
+	assertResult(result, 1, 3)
+	updater = db.Update()
+	updater.ScoreUpdate("points", 5, 0)
+	updater.Commit()
+	result, _ = db.Query().Sort("points").After(cursor).Limit(2).Execute()
+	assertResult(result, 4, 6)
+}
+
+// ids 1, 3 and 5 tie on rating, as do 2 and 4; 3 isn't recent
+func createRatedDB() *Database {
+	db, _ := New(Configure().Storage(NewMemoryStorage()))
+	updater := db.Update()
+	for id, rating := range map[Id]float64{1: 5, 2: 3, 3: 5, 4: 3, 5: 5, 6: 1} {
+		updater.ScoreUpdate("rating", id, rating)
+		if id != 3 {
+			updater.ScoreUpdate("recent", id, float64(id*10))
+		}
+	}
+	for id := Id(100); id < 1100; id++ {
+		updater.ScoreUpdate("rating", id, -float64(id))
+	}
+	updater.Commit()
+	return db
+}
+
+func idRange(from Id, to Id) []Id {
+	ids := make([]Id, 0, to-from+1)
+	for id := from; id <= to; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func assertResult(result Result, expected ...Id) {
 	defer result.Release()
 	Expect(result.Len()).To.Equal(len(expected))
 	for i, resource := range expected {
@@ -0,0 +1,173 @@
+package indexes
+
+import (
+	"database/sql"
+	"errors"
+)
+
+var (
+	ErrIdTooLarge    = errors.New("id too large for this build's Id size")
+	ErrInvalidResize = errors.New("payload isn't a whole number of ids")
+)
+
+// Databases are created with the Id size of the build which created them:
+// 4 bytes, or 8 with the ids64 tag. A database without an id_size setting
+// predates 64 bit ids, so has 4 byte ids. When opened by a build with a
+// different size, every payload is rewritten, in a single transaction, to
+// the build's size. Going from 8 to 4 bytes fails if an id doesn't fit.
+func resizeIds(db *sql.DB) error {
+	size := 4
+	err := db.QueryRow("select value from settings where key = 'id_size'").Scan(&size)
+	if err == nil && size == IdSize {
+		return nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if size != IdSize {
+		if err := resizeIndexes(tx, size); err != nil {
+			return err
+		}
+		if err := resizeDeltas(tx, size); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("insert or replace into settings (key, value) values ('id_size', ?)", IdSize); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func resizeIndexes(tx *sql.Tx, from int) error {
+	rows, err := tx.Query("select id, type from indexes")
+	if err != nil {
+		return err
+	}
+	names, types := make([]string, 0), make([]int, 0)
+	for rows.Next() {
+		var name string
+		var tpe int
+		if err := rows.Scan(&name, &tpe); err != nil {
+			rows.Close()
+			return err
+		}
+		names, types = append(names, name), append(types, tpe)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i, name := range names {
+		var payload []byte
+		if err := tx.QueryRow("select payload from indexes where id = ?", name).Scan(&payload); err != nil {
+			return err
+		}
+		resized, err := resizePayload(types[i], payload, from)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("update indexes set payload = ? where id = ?", resized, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the removed ids of a delta are a series of ids, its added ids are in the
+// same format as its index's payload
+func resizeDeltas(tx *sql.Tx, from int) error {
+	rows, err := tx.Query("select seq, type, added, removed from deltas")
+	if err != nil {
+		return err
+	}
+	seqs, types, payloads := make([]int64, 0), make([]int, 0), make([][2][]byte, 0)
+	for rows.Next() {
+		var seq int64
+		var tpe int
+		var added, removed []byte
+		if err := rows.Scan(&seq, &tpe, &added, &removed); err != nil {
+			rows.Close()
+			return err
+		}
+		seqs, types, payloads = append(seqs, seq), append(types, tpe), append(payloads, [2][]byte{added, removed})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for i, seq := range seqs {
+		added, err := resizePayload(types[i], payloads[i][0], from)
+		if err != nil {
+			return err
+		}
+		removed, err := resizeEntries(payloads[i][1], from, 0)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("update deltas set added = ?, removed = ? where seq = ?", added, removed, seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rewrites a payload of the given type from from-byte ids to IdSize-byte ids
+func resizePayload(tpe int, payload []byte, from int) ([]byte, error) {
+	switch tpe {
+	case IdsIndex:
+		ids, err := extractSizedIdMap(payload, from)
+		if err != nil {
+			return nil, err
+		}
+		return encodeIdMap(ids), nil
+	case SetIndex, ListIndex, SequenceIndex:
+		return resizeEntries(payload, from, 0)
+	case ScoredIndex, NumericIndex:
+		return resizeEntries(payload, from, 8)
+	}
+	return payload, nil
+}
+
+// payloads are a series of entries made of an id followed by extra bytes
+func resizeEntries(payload []byte, from int, extra int) ([]byte, error) {
+	stride := from + extra
+	if len(payload)%stride != 0 {
+		return nil, ErrInvalidResize
+	}
+	resized := make([]byte, 0, len(payload)/stride*(IdSize+extra))
+	scratch := make([]byte, IdSize)
+	for i := 0; i < len(payload); i += stride {
+		id, err := readSizedId(payload[i:], from)
+		if err != nil {
+			return nil, err
+		}
+		putId(scratch, id)
+		resized = append(resized, scratch...)
+		resized = append(resized, payload[i+from:i+stride]...)
+	}
+	return resized, nil
+}
+
+func readSizedId(b []byte, size int) (Id, error) {
+	if size == IdSize {
+		return readId(b), nil
+	}
+	var value uint64
+	if size == 4 {
+		value = uint64(encoder.Uint32(b))
+	} else {
+		value = encoder.Uint64(b)
+	}
+	if id := Id(value); uint64(id) == value {
+		return id, nil
+	}
+	return 0, ErrIdTooLarge
+}
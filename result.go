@@ -5,10 +5,16 @@ type Result interface {
 	Len() int
 	Ids() []Id
 	HasMore() bool
+	Total() int
+	Facets() map[string]int
+	Cursor() string
+	ExternalIds() []string
 }
 
 var (
 	EmptyResult = new(emptyResult)
+	// the empty result of a query executed WithCount or CountLimit
+	countedEmptyResult = &emptyResult{counted: true}
 )
 
 type Ranked struct {
@@ -32,7 +38,10 @@ func (r Ranks) Swap(i, j int) {
 
 type NormalResult struct {
 	length int
+	total  int
+	facets []int
 	ids    []Id
+	strs   []string
 	more   bool
 	ranked Ranks
 	query  *Query
@@ -42,6 +51,7 @@ type NormalResult struct {
 func newResult(maxSets int, maxResults int) *NormalResult {
 	result := &NormalResult{
 		ids:    make([]Id, maxResults),
+		strs:   make([]string, maxResults),
 		ranked: make(Ranks, SmallSetTreshold),
 		miss:   make([]interface{}, maxResults),
 	}
@@ -66,17 +76,58 @@ func (r *NormalResult) Ids() []Id {
 	return r.ids[:r.length]
 }
 
+// The external ids of the results, in the same order as Ids. An id without
+// an external id is returned as an empty string.
+func (r *NormalResult) ExternalIds() []string {
+	db := r.query.db
+	db.idLock.RLock()
+	for i, id := range r.ids[:r.length] {
+		r.strs[i] = db.externals[id]
+	}
+	db.idLock.RUnlock()
+	return r.strs[:r.length]
+}
+
 func (r *NormalResult) HasMore() bool {
 	return r.more
 }
 
+// The total number of matches. Only available when the query was executed
+// WithCount or CountLimit, otherwise -1.
+func (r *NormalResult) Total() int {
+	q := r.query
+	if q.count == false {
+		return -1
+	}
+	if q.countLimit > 0 && r.total > q.countLimit {
+		return q.countLimit
+	}
+	return r.total
+}
+
+// The number of matches in each of the query's facet sets
+func (r *NormalResult) Facets() map[string]int {
+	names := r.query.facetNames
+	facets := make(map[string]int, len(names))
+	for i, name := range names {
+		facets[name] = r.facets[i]
+	}
+	return facets
+}
+
 func (r *NormalResult) Release() {
 	r.length = 0
+	r.total = 0
+	for i := range r.facets {
+		r.facets[i] = 0
+	}
 	r.more = false
 	r.query.release()
 }
 
 type emptyResult struct {
+	counted bool
+	facets  []string
 }
 
 func (r *emptyResult) Len() int {
@@ -87,9 +138,30 @@ func (r *emptyResult) Ids() []Id {
 	return nil
 }
 
+func (r *emptyResult) ExternalIds() []string {
+	return nil
+}
+
 func (r *emptyResult) HasMore() bool {
 	return false
 }
 
+// Like NormalResult, -1 unless the query was executed WithCount or CountLimit
+func (r *emptyResult) Total() int {
+	if r.counted {
+		return 0
+	}
+	return -1
+}
+
+// Like NormalResult, a count (of 0) for each of the query's facets
+func (r *emptyResult) Facets() map[string]int {
+	facets := make(map[string]int, len(r.facets))
+	for _, name := range r.facets {
+		facets[name] = 0
+	}
+	return facets
+}
+
 func (r *emptyResult) Release() {
 }
@@ -0,0 +1,274 @@
+package indexes
+
+import (
+	"math"
+	"sort"
+	"sync"
+)
+
+var EmptyScoredList = NewScoredList(nil, nil)
+
+type scored struct {
+	id    Id
+	score float64
+}
+
+// A list ordered by score, lowest first, with ties ordered by id. Unlike a
+// RankedList, changing an id's score only moves that id.
+type ScoredList struct {
+	sync.RWMutex
+	entries []scored
+	scores  map[Id]float64
+	version uint64
+}
+
+// ids and scores are parallel. If an id is repeated, its last score is used
+func NewScoredList(ids []Id, scores []float64) *ScoredList {
+	l := &ScoredList{
+		entries: make([]scored, 0, len(ids)),
+		scores:  make(map[Id]float64, len(ids)),
+		version: nextListVersion(),
+	}
+	for i, id := range ids {
+		l.scores[id] = scores[i]
+	}
+	for id, score := range l.scores {
+		l.entries = append(l.entries, scored{id, score})
+	}
+	sort.Slice(l.entries, func(i, j int) bool {
+		return l.entries[i].before(l.entries[j].id, l.entries[j].score)
+	})
+	return l
+}
+
+func (l *ScoredList) Len() int {
+	return len(l.entries)
+}
+
+func (l *ScoredList) Exists(value Id) bool {
+	_, exists := l.scores[value]
+	return exists
+}
+
+func (l *ScoredList) Score(id Id) (float64, bool) {
+	score, exists := l.scores[id]
+	return score, exists
+}
+
+func (l *ScoredList) Each(desc bool, fn func(id Id) bool) {
+	l.each(0, len(l.entries), desc, func(entry scored) bool {
+		return fn(entry.id)
+	})
+}
+
+// Like Each, but starting at the id with the given rank
+func (l *ScoredList) EachFrom(rank int, desc bool, fn func(id Id) bool) {
+	start, end := rank, len(l.entries)
+	if desc {
+		start, end = 0, rank+1
+		if end > len(l.entries) {
+			end = len(l.entries)
+		}
+	}
+	if start < 0 || start >= end {
+		return
+	}
+	l.each(start, end, desc, func(entry scored) bool {
+		return fn(entry.id)
+	})
+}
+
+// Calls fn, in score order, for every id with a score between min and max
+// (inclusive)
+func (l *ScoredList) RangeByScore(min float64, max float64, desc bool, fn func(id Id, score float64) bool) {
+	start, end := l.bounds(min, max)
+	l.each(start, end, desc, func(entry scored) bool {
+		return fn(entry.id, entry.score)
+	})
+}
+
+// A set of the ids with a score between min and max (inclusive). The set is
+// a view: it reflects later changes to the list and shares its lock.
+func (l *ScoredList) Range(min float64, max float64) Set {
+	return &scoreRange{list: l, min: min, max: max}
+}
+
+func (l *ScoredList) Around(target Id, fn func(Id) bool) {
+	index, exists := l.Rank(target)
+	if exists == false {
+		return
+	}
+	for next := index + 1; next < len(l.entries); next++ {
+		if fn(l.entries[next].id) {
+			break
+		}
+	}
+	for prev := index - 1; prev > -1; prev-- {
+		if fn(l.entries[prev].id) {
+			break
+		}
+	}
+}
+
+func (l *ScoredList) Rank(id Id) (int, bool) {
+	score, exists := l.scores[id]
+	if exists == false {
+		return 0, false
+	}
+	return l.search(id, score), true
+}
+
+func (l *ScoredList) CanRank() bool {
+	return true
+}
+
+func (l *ScoredList) Version() uint64 {
+	return l.version
+}
+
+// Moves (or adds) the id to its new position. Callers must hold the lock
+func (l *ScoredList) setScore(id Id, score float64) {
+	if old, exists := l.scores[id]; exists {
+		if old == score {
+			return
+		}
+		l.removeAt(l.search(id, old))
+	}
+	l.scores[id] = score
+	i := l.search(id, score)
+	l.entries = append(l.entries, scored{})
+	copy(l.entries[i+1:], l.entries[i:])
+	l.entries[i] = scored{id, score}
+}
+
+func (l *ScoredList) apply(changes ScoreChanges) {
+	l.Lock()
+	defer l.Unlock()
+	l.version = nextListVersion()
+	for id := range changes.deleted {
+		l.remove(id)
+	}
+	for id, score := range changes.updated {
+		l.setScore(id, score)
+	}
+}
+
+// Callers must hold the lock
+func (l *ScoredList) remove(id Id) {
+	if score, exists := l.scores[id]; exists {
+		l.removeAt(l.search(id, score))
+		delete(l.scores, id)
+	}
+}
+
+func (l *ScoredList) removeAt(i int) {
+	copy(l.entries[i:], l.entries[i+1:])
+	l.entries = l.entries[:len(l.entries)-1]
+}
+
+// the index the id, with the given score, is (or would be) at
+func (l *ScoredList) search(id Id, score float64) int {
+	return sort.Search(len(l.entries), func(i int) bool {
+		return l.entries[i].before(id, score) == false
+	})
+}
+
+// the range of entries with a score between min and max
+func (l *ScoredList) bounds(min float64, max float64) (int, int) {
+	start := sort.Search(len(l.entries), func(i int) bool {
+		return l.entries[i].score >= min
+	})
+	end := sort.Search(len(l.entries), func(i int) bool {
+		return l.entries[i].score > max
+	})
+	if end < start {
+		end = start
+	}
+	return start, end
+}
+
+func (l *ScoredList) each(start int, end int, desc bool, fn func(entry scored) bool) {
+	if desc {
+		for i := end - 1; i >= start; i-- {
+			if fn(l.entries[i]) == false {
+				return
+			}
+		}
+		return
+	}
+	for i := start; i < end; i++ {
+		if fn(l.entries[i]) == false {
+			return
+		}
+	}
+}
+
+func (s scored) before(id Id, score float64) bool {
+	return s.score < score || (s.score == score && s.id < id)
+}
+
+type scoreRange struct {
+	list *ScoredList
+	min  float64
+	max  float64
+}
+
+func (r *scoreRange) viewOf() []Set {
+	return []Set{r.list}
+}
+
+func (r *scoreRange) Lock() {
+	r.list.Lock()
+}
+
+func (r *scoreRange) RLock() {
+	r.list.RLock()
+}
+
+func (r *scoreRange) Unlock() {
+	r.list.Unlock()
+}
+
+func (r *scoreRange) RUnlock() {
+	r.list.RUnlock()
+}
+
+func (r *scoreRange) Len() int {
+	start, end := r.list.bounds(r.min, r.max)
+	return end - start
+}
+
+func (r *scoreRange) Exists(value Id) bool {
+	score, exists := r.list.scores[value]
+	return exists && score >= r.min && score <= r.max
+}
+
+func (r *scoreRange) Each(desc bool, fn func(Id) bool) {
+	r.list.RangeByScore(r.min, r.max, desc, func(id Id, score float64) bool {
+		return fn(id)
+	})
+}
+
+func (r *scoreRange) Around(id Id, fn func(Id) bool) {
+	r.Each(false, fn)
+}
+
+func (r *scoreRange) CanRank() bool {
+	return false
+}
+
+func (r *scoreRange) Rank(id Id) (int, bool) {
+	return 0, false
+}
+
+// a payload is a series of id (IdSize bytes) and score (8 bytes) pairs
+func extractScoresFromIndex(blob []byte) ([]Id, []float64) {
+	l := len(blob) / (IdSize + 8)
+	ids, scores := make([]Id, l), make([]float64, l)
+	for i := 0; i < l; i++ {
+		entry := blob[i*(IdSize+8):]
+		ids[i] = readId(entry)
+		scores[i] = math.Float64frombits(encoder.Uint64(entry[IdSize:]))
+	}
+	return ids, scores
+}
@@ -0,0 +1,65 @@
+package indexes
+
+import (
+	"testing"
+
+	. "github.com/karlseguin/expect"
+)
+
+type ScoredTests struct{}
+
+func Test_Scored(t *testing.T) {
+	Expectify(new(ScoredTests), t)
+}
+
+func (_ ScoredTests) OrdersByScoreThenId() {
+	list := NewScoredList([]Id{4, 2, 9, 3, 4}, []float64{1.5, 3, -2, 1.5, 2})
+	assertScored(list, false, 9, 3, 4, 2)
+	assertScored(list, true, 2, 4, 3, 9)
+	score, _ := list.Score(4)
+	Expect(score).To.Equal(2.0)
+}
+
+func (_ ScoredTests) MovesAnUpdatedId() {
+	list := NewScoredList([]Id{1, 2, 3, 4}, []float64{10, 20, 30, 40})
+	list.setScore(1, 35)
+	assertScored(list, false, 2, 3, 1, 4)
+	list.setScore(4, 0)
+	assertScored(list, false, 4, 2, 3, 1)
+	list.setScore(5, 20)
+	assertScored(list, false, 4, 2, 5, 3, 1)
+	list.remove(3)
+	list.remove(99)
+	assertScored(list, false, 4, 2, 5, 1)
+	Expect(list.Exists(3)).To.Equal(false)
+
+	rank, exists := list.Rank(5)
+	Expect(rank, exists).To.Equal(2, true)
+	_, exists = list.Rank(3)
+	Expect(exists).To.Equal(false)
+}
+
+func (_ ScoredTests) RangesByScore() {
+	list := NewScoredList([]Id{1, 2, 3, 4, 5}, []float64{1, 2, 2, 3, 4})
+	ids := make([]Id, 0, 5)
+	list.RangeByScore(2, 3, true, func(id Id, score float64) bool {
+		ids = append(ids, id)
+		return true
+	})
+	Expect(ids).To.Equal([]Id{4, 3, 2})
+
+	set := list.Range(1.5, 3.5)
+	Expect(set.Len()).To.Equal(3)
+	Expect(set.Exists(2), set.Exists(4), set.Exists(5)).To.Equal(true, true, false)
+	Expect(list.Range(5, 9).Len()).To.Equal(0)
+}
+
+func assertScored(list *ScoredList, desc bool, expected ...Id) {
+	Expect(list.Len()).To.Equal(len(expected))
+	ids := make([]Id, 0, len(expected))
+	list.Each(desc, func(id Id) bool {
+		ids = append(ids, id)
+		return true
+	})
+	Expect(ids).To.Equal(expected)
+}
@@ -1,20 +1,26 @@
 package indexes
 
 import (
+	"container/heap"
+	"sort"
 	"sync"
-
-	"gopkg.in/karlseguin/intset.v1"
 )
 
 var (
 	EmptySet = new(emptySet)
 )
 
+// sets with fewer ids than this are SmallSets
+const smallSetMax = 32
+
 type Set interface {
 	Lock()
 	RLock()
 	Unlock()
 	RUnlock()
+	// The number of ids in the set. Views over other sets, like UnionSet, only
+	// know an upper bound; it's only ever used to estimate costs, and 0 is
+	// still exact.
 	Len() int
 	Exists(value Id) bool
 	Each(bool, func(Id) bool)
@@ -23,25 +29,43 @@ type Set interface {
 	Around(id Id, f func(id Id) bool)
 }
 
+// A set which can be changed in place, rather than rebuilt, by the updater.
+// Add and Remove must be called while holding the set's Lock.
+type MutableSet interface {
+	Set
+	Add(id Id)
+	Remove(id Id)
+}
+
+// names are only used to explain a query; a set added without one has an
+// empty name
 type Sets struct {
-	l int
-	o []Set
-	s []Set
+	l  int
+	o  []Set
+	s  []Set
+	on []string
+	n  []string
 }
 
 func NewSets(max int) *Sets {
-	o := make([]Set, max)
-	return &Sets{o: o, s: o}
+	o, on := make([]Set, max), make([]string, max)
+	return &Sets{o: o, s: o, on: on, n: on}
 }
 
 func (sets *Sets) Add(set Set) {
+	sets.add("", set)
+}
+
+func (sets *Sets) add(name string, set Set) {
 	sets.s[sets.l] = set
+	sets.n[sets.l] = name
 	sets.l++
 }
 
 func (sets *Sets) Shift() Set {
 	set := sets.s[0]
 	sets.s = sets.s[1:]
+	sets.n = sets.n[1:]
 	sets.l--
 	return set
 }
@@ -58,57 +82,57 @@ func (sets *Sets) RUnlock() {
 	}
 }
 
+// A set over other sets, like a UnionSet or a scored list's Range, locks
+// them rather than having a lock of its own
+type view interface {
+	viewOf() []Set
+}
+
+// Appends the sets whose locks guard set, skipping any already in locks
+func appendLockable(locks []Set, set Set) []Set {
+	if v, ok := set.(view); ok {
+		for _, s := range v.viewOf() {
+			locks = appendLockable(locks, s)
+		}
+		return locks
+	}
+	for _, s := range locks {
+		if s == set {
+			return locks
+		}
+	}
+	return append(locks, set)
+}
+
 // insertion sort
 func (sets *Sets) Sort() {
 	for i := 1; i < sets.l; i++ {
 		j := i
-		t := sets.s[i]
+		t, n := sets.s[i], sets.n[i]
 		l := t.Len()
 		for ; j > 0 && sets.s[j-1].Len() > l; j-- {
 			sets.s[j] = sets.s[j-1]
+			sets.n[j] = sets.n[j-1]
 		}
-		sets.s[j] = t
+		sets.s[j], sets.n[j] = t, n
 	}
 }
 
 func (sets *Sets) reset() {
 	sets.l = 0
 	sets.s = sets.o
+	sets.n = sets.on
 }
 
 func NewSet(ids []Id) Set {
 	l := len(ids)
-	if l < 32 {
+	if l < smallSetMax {
 		return NewSmallSet(ids)
 	}
-	set := intset.NewSized32(uint32(l))
-	for i := 0; i < l; i++ {
-		set.Set(uint32(ids[i]))
-	}
-	return &FixedSet{
-		ids: set,
+	if isDense(ids) {
+		return NewBitmapSet(ids)
 	}
-}
-
-type FixedSet struct {
-	sync.RWMutex
-	ids *intset.Sized32
-}
-
-func (s *FixedSet) Len() int {
-	return s.ids.Len()
-}
-
-func (s *FixedSet) Exists(value Id) bool {
-	return s.ids.Exists(uint32(value))
-}
-
-func (s *FixedSet) Each(desc bool, fn func(Id) bool) {
-	s.ids.Each(func(id uint32) {
-		if !fn(Id(id)) {
-			return
-		}
-	})
+	return newFixedSet(ids)
 }
 
 // cannot be done
@@ -169,6 +193,170 @@ func (s *SmallSet) Around(id Id, fn func(id Id) bool) {
 	s.Each(false, fn)
 }
 
+func (s *SmallSet) Add(id Id) {
+	i := s.search(id)
+	if i < len(s.ids) && s.ids[i] == id {
+		return
+	}
+	s.ids = append(s.ids, 0)
+	copy(s.ids[i+1:], s.ids[i:])
+	s.ids[i] = id
+}
+
+func (s *SmallSet) Remove(id Id) {
+	if i := s.search(id); i < len(s.ids) && s.ids[i] == id {
+		s.ids = append(s.ids[:i], s.ids[i+1:]...)
+	}
+}
+
+func (s *SmallSet) search(id Id) int {
+	return sort.Search(len(s.ids), func(i int) bool { return s.ids[i] >= id })
+}
+
+// A union of sets. An id exists if it exists in any of the sets.
+type UnionSet struct {
+	sets []Set
+}
+
+func NewUnionSet(sets []Set) *UnionSet {
+	return &UnionSet{sets: sets}
+}
+
+func (u *UnionSet) viewOf() []Set {
+	return u.sets
+}
+
+func (u *UnionSet) Lock() {
+	for _, set := range u.sets {
+		set.Lock()
+	}
+}
+
+func (u *UnionSet) RLock() {
+	for _, set := range u.sets {
+		set.RLock()
+	}
+}
+
+func (u *UnionSet) Unlock() {
+	for _, set := range u.sets {
+		set.Unlock()
+	}
+}
+
+func (u *UnionSet) RUnlock() {
+	for _, set := range u.sets {
+		set.RUnlock()
+	}
+}
+
+// The sets can overlap, so this is an upper bound of the number of
+// distinct ids
+func (u *UnionSet) Len() int {
+	l := 0
+	for _, set := range u.sets {
+		l += set.Len()
+	}
+	return l
+}
+
+func (u *UnionSet) Exists(value Id) bool {
+	for _, set := range u.sets {
+		if set.Exists(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// An id which exists in more than one set is only yielded once. Ids are
+// yielded in order: each set's ids are sorted, if they aren't already, and
+// merged, skipping duplicates.
+func (u *UnionSet) Each(desc bool, fn func(Id) bool) {
+	runs := &idRuns{desc: desc}
+	for _, set := range u.sets {
+		ids := make([]Id, 0, set.Len())
+		set.Each(false, func(id Id) bool {
+			ids = append(ids, id)
+			return true
+		})
+		if len(ids) == 0 {
+			continue
+		}
+		if sort.SliceIsSorted(ids, func(i, j int) bool { return ids[i] < ids[j] }) == false {
+			sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		}
+		if desc {
+			for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+				ids[i], ids[j] = ids[j], ids[i]
+			}
+		}
+		runs.runs = append(runs.runs, ids)
+	}
+	heap.Init(runs)
+
+	yielded, last := false, Id(0)
+	for runs.Len() > 0 {
+		id := runs.runs[0][0]
+		if runs.runs[0] = runs.runs[0][1:]; len(runs.runs[0]) == 0 {
+			heap.Pop(runs)
+		} else {
+			heap.Fix(runs, 0)
+		}
+		if yielded && id == last {
+			continue
+		}
+		if !fn(id) {
+			return
+		}
+		yielded, last = true, id
+	}
+}
+
+func (u *UnionSet) Around(id Id, fn func(Id) bool) {
+	u.Each(false, fn)
+}
+
+func (u *UnionSet) CanRank() bool {
+	return false
+}
+
+func (u *UnionSet) Rank(id Id) (int, bool) {
+	return 0, false
+}
+
+// sorted runs of ids, ordered by their first id, to merge them
+type idRuns struct {
+	desc bool
+	runs [][]Id
+}
+
+func (r *idRuns) Len() int {
+	return len(r.runs)
+}
+
+func (r *idRuns) Less(i, j int) bool {
+	if r.desc {
+		return r.runs[i][0] > r.runs[j][0]
+	}
+	return r.runs[i][0] < r.runs[j][0]
+}
+
+func (r *idRuns) Swap(i, j int) {
+	r.runs[i], r.runs[j] = r.runs[j], r.runs[i]
+}
+
+func (r *idRuns) Push(run interface{}) {
+	r.runs = append(r.runs, run.([]Id))
+}
+
+func (r *idRuns) Pop() interface{} {
+	l := len(r.runs) - 1
+	run := r.runs[l]
+	r.runs = r.runs[:l]
+	return run
+}
+
 type emptySet struct {
 }
 
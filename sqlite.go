@@ -1,20 +1,175 @@
 package indexes
 
 import (
+	"crypto/rand"
 	"database/sql"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	_ "gopkg.in/karlseguin/go-sqlite3.v1"
 )
 
 var (
 	encoder = binary.LittleEndian
+
+	ErrChangesExpired = errors.New("changes were discarded before they were read, reopen the database")
 )
 
+// A reader which hasn't read its changes for this long is forgotten, so that
+// it doesn't stop every other reader's changes from being discarded
+const readerExpiry = 24 * time.Hour
+
+// A migration's script is run first, followed by its function, if it has
+// one, for the changes sql alone can't make
+type migration struct {
+	script string
+	run    func(tx *sql.Tx) error
+}
+
+// Schema migrations, applied in order. The database's user_version is the
+// number of migrations which have been applied. Only ever append to this.
+var migrations = []migration{
+	// 1: initial schema
+	{script: `create table if not exists indexes (id string, payload blob, type int);
+	create table if not exists updated (id string, type int);`},
+
+	// 2: "insert or replace" needs ids to be unique
+	{script: `delete from indexes where rowid not in (select max(rowid) from indexes group by id);
+	create unique index if not exists indexes_id on indexes (id);`},
+
+	// 3: every write to indexes is recorded with an increasing seq. The cursor
+	// is the last seq which Changes has handed out.
+	{script: `drop table if exists updated;
+	create table changes (seq integer primary key autoincrement, id string, type int);
+	create table cursor (seq integer not null);
+	insert into cursor (seq) values (0);
+	create trigger indexes_inserted after insert on indexes begin
+		insert into changes (id, type) values (new.id, new.type);
+	end;
+	create trigger indexes_updated after update on indexes begin
+		insert into changes (id, type) values (new.id, new.type);
+	end;
+	create trigger indexes_deleted after delete on indexes begin
+		insert into changes (id, type) values (old.id, old.type);
+	end;`},
+
+	// 4: one row per id mapping, rather than a single "ids" index, so that
+	// changing a mapping doesn't rewrite all of them. Changes to a mapping are
+	// recorded with the external id and the ids type.
+	{script: `create table ids (external string primary key, id integer not null);
+	create trigger ids_inserted after insert on ids begin
+		insert into changes (id, type) values (new.external, 1);
+	end;
+	create trigger ids_updated after update on ids begin
+		insert into changes (id, type) values (new.external, 1);
+	end;
+	create trigger ids_deleted after delete on ids begin
+		insert into changes (id, type) values (old.external, 1);
+	end;`},
+
+	// 5: settings of the database itself, such as the size of its ids
+	{script: `create table settings (key string primary key, value integer not null);`},
+
+	// 6: the ids added to and removed from a set, in the order they were
+	// written, since its payload was last written in full. Writing or removing
+	// the set's payload discards them.
+	{script: `create table deltas (seq integer primary key autoincrement, id string not null, added blob, removed blob);
+	create index deltas_id on deltas (id);
+	create trigger deltas_inserted after insert on deltas begin
+		insert into changes (id, type) values (new.id, 2);
+	end;
+	create trigger indexes_compacted after insert on indexes begin
+		delete from deltas where id = new.id;
+	end;
+	create trigger indexes_dropped after delete on indexes begin
+		delete from deltas where id = old.id;
+	end;`},
+
+	// 7: every storage opened on the database reads changes from its own seq,
+	// rather than from a shared cursor. Changes are only discarded once every
+	// reader has read them.
+	{script: `drop table cursor;
+	create table readers (id string primary key, seq integer not null, seen integer not null);`},
+
+	// 8: numeric attributes get a namespace of their own, so that writing one
+	// doesn't replace a set or list with the same name
+	{script: `update changes set id = 'numeric:' || id where type = 5;
+	update indexes set id = 'numeric:' || id where type = 5;`},
+
+	// 9: the mappings of an "ids" index, written before ids had their own
+	// table, are moved into it
+	{run: moveIdMap},
+
+	// 10: scored lists and numeric attributes persist deltas too. A delta's
+	// change is recorded with the type of its index.
+	{script: `alter table deltas add column type integer not null default 2;
+	drop trigger deltas_inserted;
+	create trigger deltas_inserted after insert on deltas begin
+		insert into changes (id, type) values (new.id, new.type);
+	end;`},
+
+	// 11: a column declared as a string has numeric affinity, so an external
+	// id or name which looks like a number, say "007" or "1e3", was stored as
+	// one. The ids and changes are rebuilt with text columns. changes keeps
+	// its seq, which readers resume from.
+	{script: textIds + `create temp table saved_changes as select seq, id, type from changes;
+	create temp table saved_seq as select seq from sqlite_sequence where name = 'changes';
+	drop table changes;
+	create table changes (seq integer primary key autoincrement, id text, type int);
+	insert into changes (seq, id, type) select seq, cast(id as text), type from saved_changes;
+	delete from sqlite_sequence where name = 'changes';
+	insert into sqlite_sequence (name, seq) select 'changes', seq from saved_seq;
+	drop table saved_changes;
+	drop table saved_seq;`},
+
+	// 12: the id sequence gets a namespace of its own, so that writing it
+	// doesn't replace a set or list named "sequence"
+	{script: `update changes set id = 'sequence:ids' where type = 6;
+	update indexes set id = 'sequence:ids' where type = 6;`},
+}
+
+// Rebuilds the ids table with a text external id. The triggers go with the
+// old table, so they're created again.
+const textIds = `create temp table saved_ids as select external, id from ids;
+	drop table ids;
+	create table ids (external text primary key, id integer not null);
+	insert into ids (external, id) select cast(external as text), id from saved_ids;
+	drop table saved_ids;
+	create trigger ids_inserted after insert on ids begin
+		insert into changes (id, type) values (new.external, 1);
+	end;
+	create trigger ids_updated after update on ids begin
+		insert into changes (id, type) values (new.external, 1);
+	end;
+	create trigger ids_deleted after delete on ids begin
+		insert into changes (id, type) values (old.external, 1);
+	end;
+	`
+
+// The seq of the latest change, even once it's been discarded
+const latestChange = "select coalesce((select seq from sqlite_sequence where name = 'changes'), 0)"
+
+// satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
 type SqliteStorage struct {
 	*sql.DB
-	iIndex *sql.Stmt
-	dIndex *sql.Stmt
+	reader string
+	// the last seq which Changes has handed out
+	seq     int64
+	seqLock sync.Mutex
+	iIndex  *sql.Stmt
+	dIndex  *sql.Stmt
+	iId     *sql.Stmt
+	dId     *sql.Stmt
+	iDelta  *sql.Stmt
 }
 
 func newSqliteStorage(path string) (*SqliteStorage, error) {
@@ -24,6 +179,19 @@ func newSqliteStorage(path string) (*SqliteStorage, error) {
 	}
 
 	db.Exec("pragma synchronous=NORMAL; pragma journal_mode=WAL;")
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := resizeIds(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	reader, seq, err := register(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	iIndex, err := db.Prepare("insert or replace into indexes (type, payload, id) values (?, ?, ?)")
 	if err != nil {
@@ -35,14 +203,132 @@ func newSqliteStorage(path string) (*SqliteStorage, error) {
 		db.Close()
 		return nil, err
 	}
+	iId, err := db.Prepare("insert or replace into ids (external, id) values (?, ?)")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	dId, err := db.Prepare("delete from ids where external = ?")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	iDelta, err := db.Prepare("insert into deltas (id, type, added, removed) values (?, ?, ?, ?)")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	return &SqliteStorage{
 		DB:     db,
+		reader: reader,
+		seq:    seq,
 		iIndex: iIndex,
 		dIndex: dIndex,
+		iId:    iId,
+		dId:    dId,
+		iDelta: iDelta,
 	}, nil
 }
 
+// Creates the schema for a new database, or upgrades an existing one. Each
+// migration is applied in its own transaction along with its version.
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("pragma user_version").Scan(&version); err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		m := migrations[version]
+		if m.script != "" {
+			if _, err := tx.Exec(m.script); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if m.run != nil {
+			if err := m.run(tx); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if _, err := tx.Exec("pragma user_version = " + strconv.Itoa(version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds a reader whose changes start after the latest change
+func register(db *sql.DB) (string, int64, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", 0, err
+	}
+	reader := hex.EncodeToString(id)
+	var seq int64
+	if err := db.QueryRow(latestChange).Scan(&seq); err != nil {
+		return "", 0, err
+	}
+	_, err := db.Exec("insert into readers (id, seq, seen) values (?, ?, strftime('%s', 'now'))", reader, seq)
+	return reader, seq, err
+}
+
+// Moves the mappings of an "ids" index into the ids table. The payload's ids
+// haven't been resized yet, so are read with the size they were written with.
+func moveIdMap(tx *sql.Tx) error {
+	var payload []byte
+	err := tx.QueryRow("select payload from indexes where id = 'ids' and type = 1").Scan(&payload)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// the map's keys are moved byte for byte
+	if _, err := tx.Exec(textIds); err != nil {
+		return err
+	}
+	size := 4
+	if err := tx.QueryRow("select value from settings where key = 'id_size'").Scan(&size); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	ids, err := extractSizedIdMap(payload, size)
+	if err != nil {
+		return err
+	}
+	if err := replaceIds(tx, ids); err != nil {
+		return err
+	}
+	_, err = tx.Exec("delete from indexes where id = 'ids' and type = 1")
+	return err
+}
+
+func replaceIds(tx *sql.Tx, ids map[string]Id) error {
+	if _, err := tx.Exec("delete from ids"); err != nil {
+		return err
+	}
+	insert, err := tx.Prepare("insert into ids (external, id) values (?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	for external, id := range ids {
+		if _, err := insert.Exec(external, int64(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *SqliteStorage) ListCount() uint32 {
 	count := 0
 	s.DB.QueryRow("select count(*) from indexes where type = 3").Scan(&count)
@@ -55,40 +341,186 @@ func (s *SqliteStorage) SetCount() uint32 {
 	return uint32(count)
 }
 
-func (s *SqliteStorage) LoadIds(newOnly bool) (map[string]Id, error) {
+func (s *SqliteStorage) EachId(f func(external string, id Id)) error {
+	rows, err := s.DB.Query("select external, id from ids")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var external string
+		var id int64
+		if err := rows.Scan(&external, &id); err != nil {
+			return err
+		}
+		f(external, Id(id))
+	}
+	return rows.Err()
+}
+
+// Returns 0 when no id has been assigned yet
+func (s *SqliteStorage) LoadSequence() (Id, []Id, error) {
 	var payload []byte
-	err := s.DB.QueryRow("select payload from indexes where id = 'ids'").Scan(&payload)
+	err := s.DB.QueryRow("select payload from indexes where id = ? and type = 6", sequenceId).Scan(&payload)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, nil
+			return 0, nil, nil
 		}
-		return nil, err
+		return 0, nil, err
 	}
-	return extractIdMap(payload), nil
+	next, freed := extractSequence(payload)
+	return next, freed, nil
 }
 
-func (s *SqliteStorage) EachSet(newOnly bool, f func(name string, ids []Id)) error {
-	return s.each(newOnly, 2, f)
+func (s *SqliteStorage) EachSet(f func(name string, ids []Id)) error {
+	return s.each(SetIndex, func(name string, blob []byte) {
+		f(name, extractIdsFromIndex(blob))
+	})
 }
 
-func (s *SqliteStorage) EachList(newOnly bool, f func(name string, ids []Id)) error {
-	return s.each(newOnly, 3, f)
+func (s *SqliteStorage) EachList(f func(name string, ids []Id)) error {
+	return s.each(ListIndex, func(name string, blob []byte) {
+		f(name, extractIdsFromIndex(blob))
+	})
 }
 
-func (s *SqliteStorage) ClearNew() error {
-	_, err := s.DB.Exec("truncate table updated")
-	return err
+func (s *SqliteStorage) EachScored(f func(name string, ids []Id, scores []float64)) error {
+	return s.each(ScoredIndex, func(name string, blob []byte) {
+		ids, scores := extractScoresFromIndex(blob)
+		f(name, ids, scores)
+	})
+}
+
+func (s *SqliteStorage) EachNumeric(f func(name string, ids []Id, values []float64)) error {
+	return s.each(NumericIndex, func(name string, blob []byte) {
+		ids, values := extractScoresFromIndex(blob)
+		f(strings.TrimPrefix(name, numericPrefix), ids, values)
+	})
+}
+
+// Calls f once for every index written since this storage last read its
+// changes (or was opened), with its current payload (or as removed), and for
+// every id mapping written. Other storages opened on the same database read
+// the same changes; a change is only discarded once all of them have read it.
+func (s *SqliteStorage) Changes(f func(change *Change)) error {
+	s.seqLock.Lock()
+	defer s.seqLock.Unlock()
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// a reader which expired may have missed changes which were discarded
+	var registered int
+	if err := tx.QueryRow("select count(*) from readers where id = ?", s.reader).Scan(&registered); err != nil {
+		return err
+	}
+	if registered == 0 {
+		return ErrChangesExpired
+	}
+	cursor := s.seq
+
+	deltas, err := readDeltas(tx, `select id, added, removed from deltas
+		where id in (select id from changes where seq > ? and type != 1) order by seq`, cursor)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`select c.id, coalesce(i.type, c.type), i.id is null, i.payload, max(c.seq)
+		from changes c left join indexes i on i.id = c.id
+		where c.seq > ? and c.type != 1 group by c.id`, cursor)
+	if err != nil {
+		return err
+	}
+	last := cursor
+	change := new(Change)
+	for rows.Next() {
+		var seq int64
+		if err := rows.Scan(&change.Id, &change.Type, &change.Removed, &change.Payload, &seq); err != nil {
+			rows.Close()
+			return err
+		}
+		if seq > last {
+			last = seq
+		}
+		if change.Removed == false {
+			change.Payload = mergePayload(change.Type, change.Payload, deltas[change.Id])
+		}
+		if change.Type == NumericIndex {
+			change.Id = strings.TrimPrefix(change.Id, numericPrefix)
+		}
+		f(change)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	// the payload of a mapping is its id
+	rows, err = tx.Query(`select c.id, m.id, max(c.seq)
+		from changes c left join ids m on m.external = c.id
+		where c.seq > ? and c.type = 1 group by c.id`, cursor)
+	if err != nil {
+		return err
+	}
+	change.Type = IdsIndex
+	payload := make([]byte, IdSize)
+	for rows.Next() {
+		var seq int64
+		var id sql.NullInt64
+		if err := rows.Scan(&change.Id, &id, &seq); err != nil {
+			rows.Close()
+			return err
+		}
+		if seq > last {
+			last = seq
+		}
+		change.Removed, change.Payload = !id.Valid, nil
+		if id.Valid {
+			putId(payload, Id(id.Int64))
+			change.Payload = payload
+		}
+		f(change)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	rows.Close()
+
+	if _, err := tx.Exec("update readers set seq = ?, seen = strftime('%s', 'now') where id = ?", last, s.reader); err != nil {
+		return err
+	}
+	if err := pruneChanges(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.seq = last
+	return nil
 }
 
-func (s *SqliteStorage) each(newOnly bool, tpe int, f func(name string, ids []Id)) error {
-	var indexes *sql.Rows
-	var err error
+// f is given each payload with its deltas merged in
+// Forgets readers which haven't read their changes for a while, and discards
+// the changes every remaining reader has read. Without any reader, every
+// change can go: a reader added later starts after the latest change.
+func pruneChanges(tx *sql.Tx) error {
+	if _, err := tx.Exec("delete from readers where seen < strftime('%s', 'now') - ?", int64(readerExpiry/time.Second)); err != nil {
+		return err
+	}
+	_, err := tx.Exec("delete from changes where seq <= coalesce((select min(seq) from readers), (select max(seq) from changes))")
+	return err
+}
 
-	if newOnly {
-		indexes, err = s.DB.Query("select id, payload from indexes where id in (select id from updated where type = ?)", tpe)
-	} else {
-		indexes, err = s.DB.Query("select id, payload from indexes where type = ?", tpe)
+func (s *SqliteStorage) each(tpe int, f func(name string, blob []byte)) error {
+	deltas, err := readDeltas(s.DB, "select id, added, removed from deltas where type = ? order by seq", tpe)
+	if err != nil {
+		return err
 	}
+	indexes, err := s.DB.Query("select id, payload from indexes where type = ?", tpe)
 	if err != nil {
 		return err
 	}
@@ -99,7 +531,7 @@ func (s *SqliteStorage) each(newOnly bool, tpe int, f func(name string, ids []Id
 		var blob []byte
 		indexes.Scan(&id, &blob)
 
-		f(id, extractIdsFromIndex(blob))
+		f(id, mergePayload(tpe, blob, deltas[id]))
 	}
 	return nil
 }
@@ -122,10 +554,40 @@ func (s *SqliteStorage) RemoveSet(id string) error {
 }
 
 func (s *SqliteStorage) UpdateIds(payload []byte) (map[string]Id, error) {
-	if _, err := s.iIndex.Exec(1, payload, "ids"); err != nil {
+	ids, err := extractIdMap(payload)
+	if err != nil {
 		return nil, err
 	}
-	return extractIdMap(payload), nil
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	if err := replaceIds(tx, ids); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+func (s *SqliteStorage) Begin() (Batch, error) {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	var before int64
+	if err := tx.QueryRow(latestChange).Scan(&before); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return &sqliteBatch{
+		storage:  s,
+		before:   before,
+		tx:       tx,
+		insert:   tx.Stmt(s.iIndex),
+		insertId: tx.Stmt(s.iId),
+		deleteId: tx.Stmt(s.dId),
+		delta:    tx.Stmt(s.iDelta),
+	}, nil
 }
 
 func (s *SqliteStorage) upsertIndex(id string, tpe int, payload []byte) ([]Id, error) {
@@ -138,26 +600,164 @@ func (s *SqliteStorage) upsertIndex(id string, tpe int, payload []byte) ([]Id, e
 func (s *SqliteStorage) Close() error {
 	s.iIndex.Close()
 	s.dIndex.Close()
+	s.iId.Close()
+	s.dId.Close()
+	s.iDelta.Close()
+	// the changes this storage hasn't read no longer need to be kept for it
+	if tx, err := s.DB.Begin(); err == nil {
+		tx.Exec("delete from readers where id = ?", s.reader)
+		pruneChanges(tx)
+		tx.Commit()
+	}
 	return s.DB.Close()
 }
 
+type sqliteBatch struct {
+	storage *SqliteStorage
+	// the latest change when the batch began
+	before   int64
+	tx       *sql.Tx
+	insert   *sql.Stmt
+	insertId *sql.Stmt
+	deleteId *sql.Stmt
+	delta    *sql.Stmt
+}
+
+func (b *sqliteBatch) PutSet(id string, payload []byte) error {
+	_, err := b.insert.Exec(2, payload, id)
+	return err
+}
+
+func (b *sqliteBatch) PutSetDelta(id string, added []byte, removed []byte) error {
+	_, err := b.delta.Exec(id, SetIndex, added, removed)
+	return err
+}
+
+func (b *sqliteBatch) SetDeltas(id string) (int, bool, error) {
+	return b.countDeltas(id, SetIndex)
+}
+
+func (b *sqliteBatch) PutList(id string, payload []byte) error {
+	_, err := b.insert.Exec(3, payload, id)
+	return err
+}
+
+func (b *sqliteBatch) PutId(external string, id Id) error {
+	_, err := b.insertId.Exec(external, int64(id))
+	return err
+}
+
+func (b *sqliteBatch) RemoveId(external string) error {
+	_, err := b.deleteId.Exec(external)
+	return err
+}
+
+func (b *sqliteBatch) PutSequence(payload []byte) error {
+	_, err := b.insert.Exec(SequenceIndex, payload, sequenceId)
+	return err
+}
+
+func (b *sqliteBatch) PutScored(id string, payload []byte) error {
+	_, err := b.insert.Exec(ScoredIndex, payload, id)
+	return err
+}
+
+func (b *sqliteBatch) PutScoredDelta(id string, updated []byte, removed []byte) error {
+	_, err := b.delta.Exec(id, ScoredIndex, updated, removed)
+	return err
+}
+
+func (b *sqliteBatch) ScoredDeltas(id string) (int, bool, error) {
+	return b.countDeltas(id, ScoredIndex)
+}
+
+func (b *sqliteBatch) PutNumeric(id string, payload []byte) error {
+	_, err := b.insert.Exec(NumericIndex, payload, numericId(id))
+	return err
+}
+
+func (b *sqliteBatch) PutNumericDelta(id string, updated []byte, removed []byte) error {
+	_, err := b.delta.Exec(numericId(id), NumericIndex, updated, removed)
+	return err
+}
+
+func (b *sqliteBatch) NumericDeltas(id string) (int, bool, error) {
+	return b.countDeltas(numericId(id), NumericIndex)
+}
+
+// Read within the batch's transaction, so the count reflects every writer
+func (b *sqliteBatch) countDeltas(id string, tpe int) (int, bool, error) {
+	var count int
+	var exists bool
+	err := b.tx.QueryRow(`select count(*), exists(select 1 from indexes where id = ? and type = ?) from deltas where id = ?`, id, tpe, id).Scan(&count, &exists)
+	return count, exists, err
+}
+
+// When the storage had read every change before the batch, the changes the
+// batch records are all its own, which its database applies itself, so it
+// reads past them. Either way, the changes every reader has read are
+// discarded: a database which commits but never reloads doesn't keep them.
+func (b *sqliteBatch) Commit() error {
+	s := b.storage
+	s.seqLock.Lock()
+	defer s.seqLock.Unlock()
+	last := s.seq
+	if b.before == s.seq {
+		if err := b.tx.QueryRow(latestChange).Scan(&last); err != nil {
+			b.tx.Rollback()
+			return err
+		}
+		if _, err := b.tx.Exec("update readers set seq = ?, seen = strftime('%s', 'now') where id = ?", last, s.reader); err != nil {
+			b.tx.Rollback()
+			return err
+		}
+	}
+	if err := pruneChanges(b.tx); err != nil {
+		b.tx.Rollback()
+		return err
+	}
+	if err := b.tx.Commit(); err != nil {
+		return err
+	}
+	s.seq = last
+	return nil
+}
+
+func (b *sqliteBatch) Rollback() error {
+	return b.tx.Rollback()
+}
+
+// reads deltas, which must be ordered by seq, grouped by set
+func readDeltas(q querier, query string, args ...interface{}) (map[string][]storedDelta, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deltas := make(map[string][]storedDelta)
+	for rows.Next() {
+		var id string
+		var added, removed []byte
+		if err := rows.Scan(&id, &added, &removed); err != nil {
+			return nil, err
+		}
+		deltas[id] = append(deltas[id], storedDelta{added, removed})
+	}
+	return deltas, rows.Err()
+}
+
 func extractIdsFromIndex(blob []byte) []Id {
 	ids := make([]Id, len(blob)/IdSize)
-	for i := 0; i < len(blob); i += IdSize {
-		ids[i/IdSize] = Id(encoder.Uint32(blob[i:]))
+	for i := 0; i+IdSize <= len(blob); i += IdSize {
+		ids[i/IdSize] = readId(blob[i:])
 	}
 	return ids
 }
 
-func extractIdMap(payload []byte) map[string]Id {
-	ids := make(map[string]Id)
-	for len(payload) > 0 {
-		l := int(payload[0])
-		payload = payload[1:]
-		id := string(payload[:l])
-		payload = payload[l:]
-		ids[id] = Id(encoder.Uint32(payload))
-		payload = payload[IdSize:]
+// a sequence is the next id to assign followed by the ids which were freed
+func extractSequence(payload []byte) (Id, []Id) {
+	if len(payload) < IdSize {
+		return 0, nil
 	}
-	return ids
+	return readId(payload), extractIdsFromIndex(payload[IdSize:])
 }
@@ -1,6 +1,26 @@
 package indexes
 
-import "bytes"
+import (
+	"bytes"
+	"errors"
+	"math"
+)
+
+var (
+	ErrIdsExhausted = errors.New("every id has been assigned")
+)
+
+// The largest id is never assigned: a sequence whose next id is the largest
+// one is exhausted, rather than wrapping around to 0
+const maxId = ^Id(0)
+
+// the id after id, without wrapping around
+func nextId(id Id) Id {
+	if id == maxId {
+		return maxId
+	}
+	return id + 1
+}
 
 type Updater struct {
 	db      *Database
@@ -9,6 +29,16 @@ type Updater struct {
 	ids     map[string]Id
 	sets    map[string]Changes
 	lists   map[string]Changes
+	scores  map[string]ScoreChanges
+	values  map[string]ScoreChanges
+
+	// the sequence, once loaded by Assign or Commit
+	sequenced bool
+	next      Id
+	freed     []Id
+	// every id this updater maps an external id to, which Assign mustn't
+	// hand out again
+	taken map[Id]struct{}
 }
 
 // For sets, the key of updated is the id, and the value is meaningless
@@ -20,12 +50,22 @@ type Changes struct {
 	updated map[Id]Id
 }
 
+// For scored lists and numeric attributes, the key of updated is the id, the
+// value its new score (or value)
+type ScoreChanges struct {
+	deleted map[Id]struct{}
+	updated map[Id]float64
+}
+
 func NewUpdater(db *Database) *Updater {
 	return &Updater{
-		db:    db,
-		ids:   make(map[string]Id),
-		sets:  make(map[string]Changes),
-		lists: make(map[string]Changes),
+		db:     db,
+		ids:    make(map[string]Id),
+		sets:   make(map[string]Changes),
+		lists:  make(map[string]Changes),
+		scores: make(map[string]ScoreChanges),
+		values: make(map[string]ScoreChanges),
+		taken:  make(map[Id]struct{}),
 	}
 }
 
@@ -41,6 +81,7 @@ func (u *Updater) ListUpdate(name string, id Id, index Id) {
 
 func (u *Updater) IdsUpdate(value string, id Id) {
 	u.ids[value] = id
+	u.taken[id] = struct{}{}
 }
 
 func (u *Updater) SetDelete(name string, id Id) {
@@ -57,47 +98,280 @@ func (u *Updater) IdsDelete(value string) {
 	u.ids[value] = 0
 }
 
+// Returns the id the external id maps to, assigning it the next free id if it
+// doesn't have one. The assignment, and the sequence, are persisted on Commit.
+// With ReuseIds, a freed id is only reused once no index holds it, taking
+// this updater's deletes into account. An id which this updater already maps
+// another external id to is never assigned. Returns ErrIdsExhausted once
+// every id has been assigned.
+func (u *Updater) Assign(external string) (Id, error) {
+	if id, pending := u.ids[external]; pending {
+		if id != 0 {
+			return id, nil
+		}
+	} else if id, exists := u.db.GetMapping(external); exists {
+		return id, nil
+	}
+
+	u.loadSequence()
+	if u.db.reuseIds {
+		for i := len(u.freed) - 1; i >= 0; i-- {
+			if _, taken := u.taken[u.freed[i]]; taken {
+				continue
+			}
+			if id := u.freed[i]; u.referenced(id) == false {
+				u.freed = append(u.freed[:i], u.freed[i+1:]...)
+				u.IdsUpdate(external, id)
+				return id, nil
+			}
+		}
+	}
+	for {
+		if u.next == maxId {
+			return 0, ErrIdsExhausted
+		}
+		if _, taken := u.taken[u.next]; taken == false {
+			break
+		}
+		u.next++
+	}
+	id := u.next
+	u.next++
+	u.IdsUpdate(external, id)
+	return id, nil
+}
+
+// Whether any index still holds the id, once this updater's deletes are
+// applied. An id which is still held would bring its old memberships along
+// to whichever external id it's assigned to.
+func (u *Updater) referenced(id Id) bool {
+	// sets are locked once the database's locks are released, never under them
+	db := u.db
+	db.setLock.RLock()
+	sets := make(map[string]Set, len(db.sets))
+	for name, set := range db.sets {
+		sets[name] = set
+	}
+	db.setLock.RUnlock()
+	for name, set := range sets {
+		set.RLock()
+		exists := set.Exists(id)
+		set.RUnlock()
+		if exists && u.deletes(name, id) == false {
+			return true
+		}
+	}
+
+	db.numericLock.RLock()
+	numerics := make(map[string]*ScoredList, len(db.numerics))
+	for name, numeric := range db.numerics {
+		numerics[name] = numeric
+	}
+	db.numericLock.RUnlock()
+	for name, numeric := range numerics {
+		numeric.RLock()
+		exists := numeric.Exists(id)
+		numeric.RUnlock()
+		if exists {
+			if _, deleted := u.values[name].deleted[id]; deleted == false {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// whether this updater removes the id from the set, list or scored list
+func (u *Updater) deletes(name string, id Id) bool {
+	for _, changes := range []map[Id]struct{}{u.sets[name].deleted, u.lists[name].deleted, u.scores[name].deleted} {
+		if _, deleted := changes[id]; deleted {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets (or adds) the id's score in the scored list
+func (u *Updater) ScoreUpdate(name string, id Id, score float64) {
+	changes := u.getScores(name, u.scores)
+	delete(changes.deleted, id)
+	changes.updated[id] = score
+}
+
+func (u *Updater) ScoreDelete(name string, id Id) {
+	changes := u.getScores(name, u.scores)
+	delete(changes.updated, id)
+	changes.deleted[id] = struct{}{}
+}
+
+// Sets (or adds) the id's value for the numeric attribute
+func (u *Updater) NumericUpdate(attr string, id Id, value float64) {
+	changes := u.getScores(attr, u.values)
+	delete(changes.deleted, id)
+	changes.updated[id] = value
+}
+
+func (u *Updater) NumericDelete(attr string, id Id) {
+	changes := u.getScores(attr, u.values)
+	delete(changes.updated, id)
+	changes.deleted[id] = struct{}{}
+}
+
+// Persists the sets, lists and ids in a single batch. The in-memory indexes
+// are only replaced once the batch has been committed, so a failure leaves
+// both the storage and the database untouched.
 func (u *Updater) Commit() error {
 	db := u.db
-	u.scratch = make([]byte, 4)
+	u.scratch = make([]byte, 8)
 	u.buffer = bytes.NewBuffer(make([]byte, 0, 5*1024*1024))
 
-	sql := db.storage.(*SqliteStorage)
-	tx, err := sql.Begin()
+	batch, err := db.storage.Begin()
 	if err != nil {
 		return err
 	}
-	insert := tx.Stmt(sql.iIndex)
 
+	// sets are changed in place, and only the delta persisted, until they've
+	// had enough deltas to be rewritten
+	sets := make(map[string][]Id, len(u.sets))
+	patches := make(map[string]setPatch)
 	for name, changes := range u.sets {
+		deltas, exists, err := batch.SetDeltas(name)
+		if err != nil {
+			batch.Rollback()
+			return err
+		}
+		// a set which isn't in storage, say another process removed it, is
+		// written in full rather than leaving a delta without a payload
+		if p, ok := u.diffSet(name, changes); ok && exists && deltas < db.compactAt {
+			if len(p.added) == 0 && len(p.removed) == 0 {
+				continue
+			}
+			if err := batch.PutSetDelta(name, encodeIds(p.added), encodeIds(p.removed)); err != nil {
+				batch.Rollback()
+				return err
+			}
+			patches[name] = p
+			continue
+		}
 		u.buffer.Reset()
-		db.setSet(name, u.serializeSet(name, changes))
-		if _, err := insert.Exec(2, u.buffer.Bytes(), name); err != nil {
-			tx.Rollback()
+		sets[name] = u.serializeSet(name, changes)
+		if err := batch.PutSet(name, u.buffer.Bytes()); err != nil {
+			batch.Rollback()
 			return err
 		}
 	}
 
+	lists := make(map[string][]Id, len(u.lists))
 	for name, changes := range u.lists {
 		u.buffer.Reset()
-		db.setList(name, u.serializeList(name, changes))
-		if _, err := insert.Exec(3, u.buffer.Bytes(), name); err != nil {
-			tx.Rollback()
+		lists[name] = u.serializeList(name, changes)
+		if err := batch.PutList(name, u.buffer.Bytes()); err != nil {
+			batch.Rollback()
 			return err
 		}
 	}
-	if err := tx.Commit(); err != nil {
-		return err
+
+	// scored lists are updated in place, and only their changes persisted,
+	// like sets. Only new ones need to be created.
+	created := make(map[string][]byte)
+	for name, changes := range u.scores {
+		payload, err := u.commitScores(batch, ScoredIndex, name, db.GetScoredList(name), changes)
+		if err != nil {
+			batch.Rollback()
+			return err
+		}
+		if payload != nil {
+			created[name] = payload
+		}
 	}
 
-	u.buffer.Reset()
-	u.serializeIds(u.ids)
-	if err := u.db.UpdateIds(u.buffer.Bytes()); err != nil {
+	// same as scored lists
+	createdNumerics := make(map[string][]byte)
+	for attr, changes := range u.values {
+		payload, err := u.commitScores(batch, NumericIndex, attr, db.GetNumeric(attr), changes)
+		if err != nil {
+			batch.Rollback()
+			return err
+		}
+		if payload != nil {
+			createdNumerics[attr] = payload
+		}
+	}
+
+	if len(u.ids) > 0 {
+		u.advanceSequence()
+		u.buffer.Reset()
+		u.serializeSequence()
+		if err := batch.PutSequence(u.buffer.Bytes()); err != nil {
+			batch.Rollback()
+			return err
+		}
+	}
+
+	// only the changed mappings are written
+	for external, id := range u.ids {
+		if id == 0 {
+			err = batch.RemoveId(external)
+		} else {
+			err = batch.PutId(external, id)
+		}
+		if err != nil {
+			batch.Rollback()
+			return err
+		}
+	}
+
+	if err := batch.Commit(); err != nil {
 		return err
 	}
+	db.swap(sets, lists, patches, u.ids)
+	if u.sequenced {
+		db.setSequence(u.next, u.freed)
+	}
+	db.rescore(u.scores, created)
+	db.revalue(u.values, createdNumerics)
 	return nil
 }
 
+func (u *Updater) loadSequence() {
+	if u.sequenced == false {
+		u.next, u.freed = u.db.getSequence()
+		u.sequenced = true
+	}
+}
+
+// Keeps the sequence ahead of ids set directly through IdsUpdate and, when
+// ids are reused, frees the ids of deleted mappings.
+func (u *Updater) advanceSequence() {
+	u.loadSequence()
+	reuse := u.db.reuseIds
+	for external, id := range u.ids {
+		if id == 0 {
+			if old, exists := u.db.GetMapping(external); exists && reuse {
+				u.freed = append(u.freed, old)
+			}
+		} else if id >= u.next {
+			u.next = nextId(id)
+		}
+	}
+	if reuse == false || len(u.freed) == 0 {
+		u.freed = nil
+		return
+	}
+	// an id which was freed can be taken again through IdsUpdate
+	freed := u.freed[:0]
+	taken := make(map[Id]struct{}, len(u.ids))
+	for _, id := range u.ids {
+		taken[id] = struct{}{}
+	}
+	for _, id := range u.freed {
+		if _, exists := taken[id]; exists == false {
+			freed = append(freed, id)
+		}
+	}
+	u.freed = freed
+}
+
 func (u *Updater) get(name string, container map[string]Changes) Changes {
 	if changes, exists := container[name]; exists {
 		return changes
@@ -110,6 +384,54 @@ func (u *Updater) get(name string, container map[string]Changes) Changes {
 	return changes
 }
 
+func (u *Updater) getScores(name string, container map[string]ScoreChanges) ScoreChanges {
+	if changes, exists := container[name]; exists {
+		return changes
+	}
+	changes := ScoreChanges{
+		updated: make(map[Id]float64),
+		deleted: make(map[Id]struct{}),
+	}
+	container[name] = changes
+	return changes
+}
+
+// A delta to apply to a live set
+type setPatch struct {
+	set MutableSet
+	setDelta
+}
+
+// Returns the ids the changes actually add to and remove from the live set,
+// or false if the set should be rewritten: it doesn't exist or can't be
+// changed in place, or it would outgrow a SmallSet.
+func (u *Updater) diffSet(name string, changes Changes) (setPatch, bool) {
+	set, ok := u.db.GetSet(name).(MutableSet)
+	if ok == false {
+		return setPatch{}, false
+	}
+	set.RLock()
+	defer set.RUnlock()
+	if _, small := set.(*SmallSet); small && set.Len()+len(changes.updated) >= smallSetMax {
+		return setPatch{}, false
+	}
+
+	// the same outcome as serializeSet, which keeps an existing id only if it
+	// isn't deleted and adds a new id even if it's also deleted
+	p := setPatch{set: set}
+	for id := range changes.deleted {
+		if set.Exists(id) {
+			p.removed = append(p.removed, id)
+		}
+	}
+	for id := range changes.updated {
+		if set.Exists(id) == false {
+			p.added = append(p.added, id)
+		}
+	}
+	return p, true
+}
+
 // Serializing a set is pretty simple. We take the existing set, serialize
 // each id which we don't want to delete and add to that any new ids that don't
 // already exists.
@@ -167,31 +489,71 @@ func (u *Updater) serializeList(name string, changes Changes) []Id {
 	return extractIdsFromIndex(u.buffer.Bytes())
 }
 
-func (u *Updater) serializeIds(ids map[string]Id) {
-	existing := u.db.getIds()
+// Persists the changes to a scored list, or numeric attribute, as a delta
+// or, when it's new, missing from storage or due for compaction, in full.
+// Returns the full payload of one which doesn't exist yet.
+func (u *Updater) commitScores(batch Batch, tpe int, name string, existing *ScoredList, changes ScoreChanges) ([]byte, error) {
+	count, put, putDelta := batch.ScoredDeltas, batch.PutScored, batch.PutScoredDelta
+	if tpe == NumericIndex {
+		count, put, putDelta = batch.NumericDeltas, batch.PutNumeric, batch.PutNumericDelta
+	}
+	deltas, exists, err := count(name)
+	if err != nil {
+		return nil, err
+	}
 
-	// only add existing ones that aren't in our change set
-	for key, id := range existing {
-		if _, exists := ids[key]; !exists {
-			u.writeMap(key, id)
+	u.buffer.Reset()
+	if exists && existing != EmptyScoredList && deltas < u.db.compactAt {
+		removed := make([]Id, 0, len(changes.deleted))
+		for id := range changes.deleted {
+			removed = append(removed, id)
+		}
+		for id, score := range changes.updated {
+			u.writeScore(id, score)
 		}
+		return nil, putDelta(name, u.buffer.Bytes(), encodeIds(removed))
+	}
+
+	if u.serializeScored(existing, changes) {
+		return nil, put(name, u.buffer.Bytes())
 	}
+	payload := copyPayload(u.buffer.Bytes())
+	return payload, put(name, payload)
+}
 
-	// add the new values
-	for key, id := range ids {
-		if id != 0 { // skip deletes
-			u.writeMap(key, id)
+// Order doesn't matter, the list is sorted when it's loaded. Returns false
+// if the list doesn't exist yet.
+func (u *Updater) serializeScored(existing *ScoredList, changes ScoreChanges) bool {
+	existing.RLock()
+	for _, entry := range existing.entries {
+		_, deleted := changes.deleted[entry.id]
+		_, updated := changes.updated[entry.id]
+		if !deleted && !updated {
+			u.writeScore(entry.id, entry.score)
 		}
 	}
+	existing.RUnlock()
+
+	for id, score := range changes.updated {
+		u.writeScore(id, score)
+	}
+	return existing != EmptyScoredList
+}
+
+func (u *Updater) serializeSequence() {
+	u.write(u.next)
+	for _, id := range u.freed {
+		u.write(id)
+	}
 }
 
 func (u *Updater) write(id Id) {
-	encoder.PutUint32(u.scratch, uint32(id))
-	u.buffer.Write(u.scratch)
+	putId(u.scratch, id)
+	u.buffer.Write(u.scratch[:IdSize])
 }
 
-func (u *Updater) writeMap(key string, id Id) {
-	u.buffer.WriteByte(byte(len(key)))
-	u.buffer.WriteString(key)
+func (u *Updater) writeScore(id Id, score float64) {
 	u.write(id)
+	encoder.PutUint64(u.scratch, math.Float64bits(score))
+	u.buffer.Write(u.scratch[:8])
 }
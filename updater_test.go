@@ -1,8 +1,13 @@
 package indexes
 
 import (
+	"errors"
 	"io/ioutil"
+	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 
 	. "github.com/karlseguin/expect"
 )
@@ -44,6 +49,195 @@ func (_ UpdaterTests) UpdatesASet() {
 	Expect(set.Exists(5)).To.Equal(true)
 }
 
+func (_ UpdaterTests) PersistsOnlyASetsDelta() {
+	db := createDB()
+	defer db.Close()
+	reloaded := createDB()
+	defer reloaded.Close()
+
+	var before []byte
+	sql := db.storage.(*SqliteStorage)
+	sql.QueryRow("select payload from indexes where id = '7'").Scan(&before)
+
+	updater := db.Update()
+	updater.SetUpdate("7", 6)
+	updater.SetDelete("7", 2)
+	Expect(updater.Commit()).To.Equal(nil)
+
+	var after []byte
+	var count int
+	sql.QueryRow("select payload from indexes where id = '7'").Scan(&after)
+	sql.QueryRow("select count(*) from deltas where id = '7'").Scan(&count)
+	Expect(after, count).To.Equal(before, 1)
+
+	// the delta is merged in by databases reloading or loading the set
+	reloaded.Reload()
+	loaded := createDB()
+	defer loaded.Close()
+	for _, d := range []*Database{db, loaded, reloaded} {
+		set := d.GetSet("7")
+		Expect(set.Len(), set.Exists(6), set.Exists(2)).To.Equal(4, true, false)
+	}
+
+	// writing the set in full discards its deltas
+	db.UpdateSet("7", before)
+	sql.QueryRow("select count(*) from deltas where id = '7'").Scan(&count)
+	Expect(count, db.GetSet("7").Exists(2)).To.Equal(0, true)
+}
+
+func (_ UpdaterTests) ChangesSetsInPlace() {
+	sparse, dense := make([]Id, 40), make([]Id, 2000)
+	for i := range sparse {
+		sparse[i] = Id(i * 100000)
+	}
+	for i := range dense {
+		dense[i] = Id(i)
+	}
+	storage := NewMemoryStorage()
+	storage.UpsertSet("small", encodeIds([]Id{1, 2, 3}))
+	storage.UpsertSet("sparse", encodeIds(sparse))
+	storage.UpsertSet("dense", encodeIds(dense))
+	db, _ := New(Configure().Storage(storage))
+	defer db.Close()
+	small := db.GetSet("small")
+	originals := []Set{small, db.GetSet("sparse"), db.GetSet("dense")}
+
+	updater := db.Update()
+	updater.SetUpdate("small", 7)
+	updater.SetDelete("small", 2)
+	updater.SetUpdate("sparse", 7)
+	updater.SetDelete("sparse", 100000)
+	updater.SetUpdate("dense", 5000)
+	updater.SetDelete("dense", 2)
+	Expect(updater.Commit()).To.Equal(nil)
+
+	for _, name := range []string{"small", "sparse", "dense"} {
+		Expect(len(storage.indexes[name].deltas)).To.Equal(1)
+	}
+	Expect(len(storage.indexes["small"].payload)).To.Equal(3 * IdSize)
+
+	loaded, _ := New(Configure().Storage(storage))
+	defer loaded.Close()
+	added, removed := []Id{7, 7, 5000}, []Id{2, 100000, 2}
+	for i, name := range []string{"small", "sparse", "dense"} {
+		Expect(db.GetSet(name) == originals[i]).To.Equal(true)
+		for _, d := range []*Database{db, loaded} {
+			set := d.GetSet(name)
+			Expect(set.Exists(added[i]), set.Exists(removed[i])).To.Equal(true, false)
+		}
+	}
+	Expect(small.Len(), loaded.GetSet("sparse").Len(), loaded.GetSet("dense").Len()).To.Equal(3, 40, 2000)
+	assertSet(small, 1, 3, 7)
+}
+
+func (_ UpdaterTests) CompactsASetAfterEnoughDeltas() {
+	storage := NewMemoryStorage()
+	storage.UpsertSet("odd", encodeIds([]Id{1, 3}))
+	db, _ := New(Configure().Storage(storage).CompactSetsAfter(2))
+	defer db.Close()
+	original := db.GetSet("odd")
+
+	for i := Id(0); i < 3; i++ {
+		updater := db.Update()
+		updater.SetUpdate("odd", 5+i*2)
+		Expect(updater.Commit()).To.Equal(nil)
+		Expect(db.GetSet("odd") == original).To.Equal(i < 2)
+	}
+	Expect(len(storage.indexes["odd"].deltas)).To.Equal(0)
+	Expect(len(storage.indexes["odd"].payload)).To.Equal(5 * IdSize)
+	assertSet(db.GetSet("odd"), 1, 3, 5, 7, 9)
+}
+
+func (_ UpdaterTests) CountsDeltasWrittenByEveryDatabase() {
+	dir, _ := ioutil.TempDir("", "indexes")
+	defer os.RemoveAll(dir)
+	c := Configure().Path(path.Join(dir, "deltas.db")).CompactSetsAfter(2)
+	first, _ := New(c)
+	defer first.Close()
+	Expect(first.UpdateSet("odd", encodeIds([]Id{1, 3}))).To.Equal(nil)
+	second, _ := New(c)
+	defer second.Close()
+
+	var count int
+	sql := first.storage.(*SqliteStorage)
+	for i, db := range []*Database{first, second, first} {
+		updater := db.Update()
+		updater.SetUpdate("odd", Id(5+i*2))
+		Expect(updater.Commit()).To.Equal(nil)
+		sql.QueryRow("select count(*) from deltas where id = 'odd'").Scan(&count)
+		Expect(count).To.Equal([]int{1, 2, 0}[i])
+	}
+
+	// and starts counting again after another database compacts
+	updater := second.Update()
+	updater.SetUpdate("odd", 11)
+	Expect(updater.Commit()).To.Equal(nil)
+	sql.QueryRow("select count(*) from deltas where id = 'odd'").Scan(&count)
+	Expect(count).To.Equal(1)
+}
+
+func (_ UpdaterTests) RewritesASetRemovedByAnotherDatabase() {
+	dir, _ := ioutil.TempDir("", "indexes")
+	defer os.RemoveAll(dir)
+	c := Configure().Path(path.Join(dir, "removed.db"))
+	first, _ := New(c)
+	defer first.Close()
+	Expect(first.UpdateSet("odd", encodeIds([]Id{1, 3}))).To.Equal(nil)
+	second, _ := New(c)
+	defer second.Close()
+	Expect(second.RemoveSet("odd")).To.Equal(nil)
+
+	updater := first.Update()
+	updater.SetUpdate("odd", 5)
+	Expect(updater.Commit()).To.Equal(nil)
+
+	var count int
+	sql := first.storage.(*SqliteStorage)
+	sql.QueryRow("select count(*) from deltas where id = 'odd'").Scan(&count)
+	Expect(count).To.Equal(0)
+	Expect(second.Reload()).To.Equal(nil)
+	loaded, _ := New(c)
+	defer loaded.Close()
+	for _, db := range []*Database{first, second, loaded} {
+		assertSet(db.GetSet("odd"), 1, 3, 5)
+	}
+}
+
+func (_ UpdaterTests) QueriesDontBlockCommits() {
+	storage := NewMemoryStorage()
+	storage.UpsertSet("a", encodeIds([]Id{1, 2}))
+	storage.UpsertSet("b", encodeIds([]Id{2, 3}))
+	db, _ := New(Configure().Storage(storage))
+	defer db.Close()
+
+	// a query without a sort is driven by one of its sets
+	result, _ := db.Query().And("a").Execute()
+	assertResult(result, 1, 2)
+	updater := db.Update()
+	updater.SetUpdate("a", 3)
+	Expect(within(func() { updater.Commit() })).To.Equal(true)
+	Expect(db.GetSet("a").Exists(3)).To.Equal(true)
+
+	// nor does one which reads a set more than once, while commits wait on it
+	queried := make(chan struct{})
+	go func() {
+		defer close(queried)
+		for i := 0; i < 500; i++ {
+			result, _ := db.Query().Or("a", "b").And("a").Facets("a", "b").Execute()
+			result.Release()
+		}
+	}()
+	committed := within(func() {
+		for i := Id(0); i < 50; i++ {
+			updater := db.Update()
+			updater.SetUpdate("a", 10+i)
+			updater.SetUpdate("b", 10+i)
+			updater.Commit()
+		}
+	})
+	Expect(committed, within(func() { <-queried })).To.Equal(true, true)
+}
+
 func (_ UpdaterTests) UpdatesAList() {
 	db := createDB()
 	defer db.Close()
@@ -87,4 +281,470 @@ func (_ UpdaterTests) UpdatesIds() {
 	Expect(db.ids["7r"]).To.Equal(Id(0))
 	Expect(db.ids["13r"]).To.Equal(Id(0))
 	Expect(db.ids["3r"]).To.Equal(Id(2))
+
+	// only the changed mappings are written
+	var count, x int
+	sql := db.storage.(*SqliteStorage)
+	sql.QueryRow("select count(*) from ids").Scan(&count)
+	sql.QueryRow("select id from ids where external = 'x'").Scan(&x)
+	Expect(count, x).To.Equal(size-1, 19)
+
+	external, _ := db.GetExternalId(19)
+	Expect(external).To.Equal("x")
+	_, exists := db.GetExternalId(4)
+	Expect(exists).To.Equal(false)
+	external, _ = db.GetExternalId(2)
+	Expect(external).To.Equal("3r")
+}
+
+func (_ UpdaterTests) CommitsThroughAnyStorage() {
+	storage := NewMemoryStorage()
+	db, _ := New(Configure().Storage(storage))
+	defer db.Close()
+
+	updater := db.Update()
+	updater.SetUpdate("odd", 1)
+	updater.SetUpdate("odd", 3)
+	updater.ListUpdate("recent", 3, 0)
+	updater.ListUpdate("recent", 2, 1)
+	updater.IdsUpdate("1r", 1)
+	Expect(updater.Commit()).To.Equal(nil)
+
+	// a new database over the same storage sees the committed changes
+	db, _ = New(Configure().Storage(storage))
+	Expect(db.GetSet("odd").Len()).To.Equal(2)
+	id, _ := db.GetMapping("1r")
+	Expect(id).To.Equal(Id(1))
+	result, _ := db.Query().Sort("recent").And("odd").Execute()
+	assertResult(result, 3)
+}
+
+func (_ UpdaterTests) UpdatesAScoredList() {
+	storage := NewMemoryStorage()
+	db, _ := New(Configure().Storage(storage))
+	defer db.Close()
+
+	updater := db.Update()
+	updater.ScoreUpdate("points", 1, 10)
+	updater.ScoreUpdate("points", 2, 30)
+	updater.ScoreUpdate("points", 3, 20)
+	Expect(updater.Commit()).To.Equal(nil)
+	result, _ := db.Query().Sort("points").Desc().Execute()
+	assertResult(result, 2, 3, 1)
+
+	list := db.GetScoredList("points")
+	updater = db.Update()
+	updater.ScoreUpdate("points", 1, 40)
+	updater.ScoreDelete("points", 2)
+	Expect(updater.Commit()).To.Equal(nil)
+	Expect(db.GetScoredList("points")).To.Equal(list)
+	result, _ = db.Query().Sort("points").Desc().Execute()
+	assertResult(result, 1, 3)
+
+	db, _ = New(Configure().Storage(storage))
+	result, _ = db.Query().Sort("points").Execute()
+	assertResult(result, 3, 1)
+}
+
+func (_ UpdaterTests) PersistsOnlyTheDeltaOfScores() {
+	dir, _ := ioutil.TempDir("", "indexes")
+	defer os.RemoveAll(dir)
+	c := Configure().Path(path.Join(dir, "scores.db")).CompactSetsAfter(2)
+	db, _ := New(c)
+	defer db.Close()
+	reloaded, _ := New(c)
+	defer reloaded.Close()
+
+	updater := db.Update()
+	updater.ScoreUpdate("points", 1, 10)
+	updater.ScoreUpdate("points", 2, 30)
+	updater.ScoreUpdate("points", 3, 20)
+	updater.NumericUpdate("price", 1, 5)
+	Expect(updater.Commit()).To.Equal(nil)
+
+	var before, after []byte
+	var points, prices int
+	sql := db.storage.(*SqliteStorage)
+	sql.QueryRow("select payload from indexes where id = 'points'").Scan(&before)
+
+	updater = db.Update()
+	updater.ScoreUpdate("points", 1, 40)
+	updater.ScoreDelete("points", 2)
+	updater.NumericUpdate("price", 1, 7)
+	Expect(updater.Commit()).To.Equal(nil)
+	sql.QueryRow("select payload from indexes where id = 'points'").Scan(&after)
+	sql.QueryRow("select count(*) from deltas where id = 'points'").Scan(&points)
+	sql.QueryRow("select count(*) from deltas where id = 'numeric:price'").Scan(&prices)
+	Expect(after, points, prices).To.Equal(before, 1, 1)
+
+	// the deltas are merged in by databases reloading or loading the list
+	Expect(reloaded.Reload()).To.Equal(nil)
+	loaded, _ := New(c)
+	defer loaded.Close()
+	for _, d := range []*Database{db, reloaded, loaded} {
+		result, _ := d.Query().Sort("points").Execute()
+		assertResult(result, 3, 1)
+		value, _ := d.GetNumeric("price").Score(1)
+		Expect(value).To.Equal(7.0)
+	}
+
+	// until enough deltas have been written
+	for i := 0; i < 2; i++ {
+		updater = db.Update()
+		updater.ScoreUpdate("points", 4, float64(i))
+		Expect(updater.Commit()).To.Equal(nil)
+	}
+	sql.QueryRow("select payload from indexes where id = 'points'").Scan(&after)
+	sql.QueryRow("select count(*) from deltas where id = 'points'").Scan(&points)
+	Expect(len(after), points).To.Equal(3*(IdSize+8), 0)
+	result, _ := db.Query().Sort("points").Execute()
+	assertResult(result, 4, 3, 1)
+}
+
+func (_ UpdaterTests) QueriesDontBlockScoreCommits() {
+	db, _ := New(Configure().Storage(NewMemoryStorage()))
+	defer db.Close()
+	updater := db.Update()
+	updater.ScoreUpdate("points", 1, 1)
+	updater.ScoreUpdate("points", 2, 2)
+	updater.NumericUpdate("price", 1, 5)
+	updater.NumericUpdate("price", 2, 15)
+	Expect(updater.Commit()).To.Equal(nil)
+
+	// queries without a sort, driven by the list or by a range of values
+	result, _ := db.Query().And("points").Execute()
+	assertResult(result, 1, 2)
+	result, _ = db.Query().Range("price", 0, 10).Execute()
+	assertResult(result, 1)
+	updater = db.Update()
+	updater.ScoreUpdate("points", 3, 3)
+	updater.NumericUpdate("price", 3, 8)
+	Expect(within(func() { updater.Commit() })).To.Equal(true)
+	result, _ = db.Query().Sort("points").Range("price", 0, 10).Execute()
+	assertResult(result, 1, 3)
+
+	queried := make(chan struct{})
+	go func() {
+		defer close(queried)
+		for i := 0; i < 500; i++ {
+			result, _ := db.Query().Sort("points").And("points").Range("price", 0, 100).Range("price", 0, 10).Execute()
+			result.Release()
+		}
+	}()
+	committed := within(func() {
+		for i := 0; i < 50; i++ {
+			updater := db.Update()
+			updater.ScoreUpdate("points", 4, float64(i))
+			updater.NumericUpdate("price", 4, float64(i))
+			updater.Commit()
+		}
+	})
+	Expect(committed, within(func() { <-queried })).To.Equal(true, true)
+}
+
+func (_ UpdaterTests) FiltersByANumericRange() {
+	storage := NewMemoryStorage()
+	db, _ := New(Configure().Storage(storage))
+	defer db.Close()
+
+	updater := db.Update()
+	for id := Id(1); id <= 1000; id++ {
+		updater.ScoreUpdate("recent", id, float64(id))
+		updater.NumericUpdate("price", id, float64(id%100))
+	}
+	Expect(updater.Commit()).To.Equal(nil)
+
+	result, _ := db.Query().Sort("recent").Range("price", 10.5, 12).Limit(3).Execute()
+	assertResult(result, 11, 12, 111)
+	plan, _ := db.Query().Sort("recent").Range("price", 10.5, 12).Limit(3).Explain()
+	Expect(plan.Strategy).To.Equal(SetStrategy)
+	Expect(plan.Driver).To.Equal("price")
+
+	updater = db.Update()
+	updater.NumericUpdate("price", 5, 11)
+	updater.NumericDelete("price", 11)
+	Expect(updater.Commit()).To.Equal(nil)
+
+	db, _ = New(Configure().Storage(storage))
+	result, _ = db.Query().Sort("recent").Range("price", 10.5, 12).Limit(3).Execute()
+	assertResult(result, 5, 12, 111)
+	result, _ = db.Query().Sort("recent").Range("unknown", 0, 100).Execute()
+	assertResult(result)
+}
+
+func (_ UpdaterTests) NumericAttributesDontReplaceSetsOfTheSameName() {
+	dir, _ := ioutil.TempDir("", "indexes")
+	defer os.RemoveAll(dir)
+	configs := []*Configuration{Configure().Storage(NewMemoryStorage()), Configure().Path(path.Join(dir, "numeric.db"))}
+	for _, c := range configs {
+		db, _ := New(c)
+		reloaded, _ := New(c)
+
+		Expect(db.UpdateSet("price", encodeIds([]Id{3, 4}))).To.Equal(nil)
+		updater := db.Update()
+		updater.NumericUpdate("price", 3, 10)
+		Expect(updater.Commit()).To.Equal(nil)
+		Expect(reloaded.Reload()).To.Equal(nil)
+
+		loaded, _ := New(c)
+		for _, d := range []*Database{db, reloaded, loaded} {
+			Expect(d.GetSet("price").Len()).To.Equal(2)
+			value, _ := d.GetNumeric("price").Score(3)
+			Expect(value).To.Equal(10.0)
+		}
+		db.Close()
+		reloaded.Close()
+		loaded.Close()
+	}
+}
+
+func (_ UpdaterTests) PersistsLongExternalIds() {
+	storage := NewMemoryStorage()
+	db, _ := New(Configure().Storage(storage))
+	defer db.Close()
+
+	key := strings.Repeat("x", 1000)
+	updater := db.Update()
+	updater.IdsUpdate(key, 3)
+	updater.IdsUpdate("short", 4)
+	Expect(updater.Commit()).To.Equal(nil)
+
+	db, _ = New(Configure().Storage(storage))
+	id, _ := db.GetMapping(key)
+	Expect(id).To.Equal(Id(3))
+	id, _ = db.GetMapping("short")
+	Expect(id).To.Equal(Id(4))
+}
+
+func (_ UpdaterTests) PersistsExternalIdsWhichLookLikeNumbers() {
+	dir, _ := ioutil.TempDir("", "indexes")
+	defer os.RemoveAll(dir)
+	c := Configure().Path(path.Join(dir, "external.db"))
+	db, _ := New(c)
+	defer db.Close()
+	reloaded, _ := New(c)
+	defer reloaded.Close()
+
+	externals := []string{"007", "7", "1e3", "12.50", "01", "1"}
+	updater := db.Update()
+	for i, external := range externals {
+		updater.IdsUpdate(external, Id(i+1))
+	}
+	Expect(updater.Commit()).To.Equal(nil)
+
+	Expect(reloaded.Reload()).To.Equal(nil)
+	loaded, _ := New(c)
+	defer loaded.Close()
+	for _, d := range []*Database{reloaded, loaded} {
+		for i, external := range externals {
+			id, _ := d.GetMapping(external)
+			Expect(id).To.Equal(Id(i + 1))
+		}
+		_, exists := d.GetMapping("1000")
+		Expect(exists).To.Equal(false)
+	}
+}
+
+func (_ UpdaterTests) AssignsIds() {
+	storage := NewMemoryStorage()
+	db, _ := New(Configure().Storage(storage))
+	defer db.Close()
+
+	updater := db.Update()
+	Expect(assign(updater, "a"), assign(updater, "b"), assign(updater, "a")).To.Equal(Id(1), Id(2), Id(1))
+	Expect(updater.Commit()).To.Equal(nil)
+	id, _ := db.GetMapping("b")
+	Expect(id).To.Equal(Id(2))
+
+	updater = db.Update()
+	updater.IdsDelete("b")
+	Expect(assign(updater, "a"), assign(updater, "c")).To.Equal(Id(1), Id(3))
+	updater.IdsUpdate("d", 10)
+	Expect(updater.Commit()).To.Equal(nil)
+
+	db, _ = New(Configure().Storage(storage))
+	Expect(db.Update().Assign("e")).To.Equal(Id(11), nil)
+}
+
+func (_ UpdaterTests) DoesntAssignIdsMappedByTheSameUpdater() {
+	db, _ := New(Configure().Storage(NewMemoryStorage()).ReuseIds())
+	defer db.Close()
+
+	updater := db.Update()
+	updater.IdsUpdate("y", 1)
+	updater.IdsUpdate("z", 3)
+	Expect(assign(updater, "x"), assign(updater, "w")).To.Equal(Id(2), Id(4))
+	Expect(updater.Commit()).To.Equal(nil)
+
+	// nor a freed id which the updater maps again
+	updater = db.Update()
+	updater.IdsDelete("x")
+	Expect(updater.Commit()).To.Equal(nil)
+	updater = db.Update()
+	updater.IdsUpdate("v", 2)
+	Expect(assign(updater, "u")).To.Equal(Id(5))
+	Expect(updater.Commit()).To.Equal(nil)
+	for external, expected := range map[string]Id{"y": 1, "v": 2, "z": 3, "w": 4, "u": 5} {
+		id, _ := db.GetMapping(external)
+		Expect(id).To.Equal(expected)
+	}
+}
+
+func (_ UpdaterTests) KeepsTheSequenceApartFromASetOfTheSameName() {
+	dir, _ := ioutil.TempDir("", "indexes")
+	defer os.RemoveAll(dir)
+	configs := []*Configuration{Configure().Storage(NewMemoryStorage()), Configure().Path(path.Join(dir, "sequence.db"))}
+	for _, c := range configs {
+		db, _ := New(c)
+		updater := db.Update()
+		updater.SetUpdate("sequence", 7)
+		updater.SetUpdate("sequence", 8)
+		Expect(updater.Commit()).To.Equal(nil)
+		updater = db.Update()
+		Expect(assign(updater, "a")).To.Equal(Id(1))
+		Expect(updater.Commit()).To.Equal(nil)
+		updater = db.Update()
+		updater.SetUpdate("sequence", 9)
+		Expect(updater.Commit()).To.Equal(nil)
+		db.Close()
+
+		db, _ = New(c)
+		Expect(db.GetSet("sequence").Len()).To.Equal(3)
+		Expect(db.Update().Assign("b")).To.Equal(Id(2), nil)
+		db.Close()
+	}
+}
+
+func (_ UpdaterTests) RunsOutOfIds() {
+	db, _ := New(Configure().Storage(NewMemoryStorage()))
+	defer db.Close()
+
+	updater := db.Update()
+	updater.IdsUpdate("a", maxId-2)
+	Expect(updater.Commit()).To.Equal(nil)
+
+	updater = db.Update()
+	Expect(updater.Assign("b")).To.Equal(maxId-1, nil)
+	Expect(updater.Assign("c")).To.Equal(Id(0), ErrIdsExhausted)
+	Expect(updater.Commit()).To.Equal(nil)
+	Expect(db.Update().Assign("c")).To.Equal(Id(0), ErrIdsExhausted)
+}
+
+func (_ UpdaterTests) ReusesFreedIds() {
+	storage := NewMemoryStorage()
+	db, _ := New(Configure().Storage(storage).ReuseIds())
+	defer db.Close()
+
+	updater := db.Update()
+	assign(updater, "a")
+	assign(updater, "b")
+	assign(updater, "c")
+	Expect(updater.Commit()).To.Equal(nil)
+
+	updater = db.Update()
+	updater.IdsDelete("b")
+	Expect(updater.Commit()).To.Equal(nil)
+
+	db, _ = New(Configure().Storage(storage).ReuseIds())
+	updater = db.Update()
+	Expect(assign(updater, "d"), assign(updater, "e")).To.Equal(Id(2), Id(4))
+}
+
+func (_ UpdaterTests) DoesntReuseIdsWhichAreStillHeld() {
+	db, _ := New(Configure().Storage(NewMemoryStorage()).ReuseIds())
+	defer db.Close()
+
+	updater := db.Update()
+	assign(updater, "a")
+	assign(updater, "b")
+	updater.SetUpdate("odd", 1)
+	updater.NumericUpdate("price", 2, 10)
+	Expect(updater.Commit()).To.Equal(nil)
+
+	updater = db.Update()
+	updater.IdsDelete("a")
+	updater.IdsDelete("b")
+	Expect(updater.Commit()).To.Equal(nil)
+
+	updater = db.Update()
+	Expect(assign(updater, "c")).To.Equal(Id(3))
+	updater.NumericDelete("price", 2)
+	Expect(assign(updater, "d")).To.Equal(Id(2))
+	Expect(updater.Commit()).To.Equal(nil)
+
+	updater = db.Update()
+	updater.SetDelete("odd", 1)
+	Expect(assign(updater, "e")).To.Equal(Id(1))
+}
+
+func assign(updater *Updater, external string) Id {
+	id, err := updater.Assign(external)
+	Expect(err).To.Equal(nil)
+	return id
+}
+
+// a SmallSet yields its ids in order
+func assertSet(set Set, expected ...Id) {
+	actual := make([]Id, 0, len(expected))
+	set.Each(false, func(id Id) bool {
+		actual = append(actual, id)
+		return true
+	})
+	Expect(actual).To.Equal(expected)
+}
+
+func (_ UpdaterTests) FailedCommitLeavesTheDatabaseUntouched() {
+	storage := &failingStorage{NewMemoryStorage()}
+	storage.UpsertSet("odd", encodeIds([]Id{1}))
+	db, _ := New(Configure().Storage(storage))
+	defer db.Close()
+
+	updater := db.Update()
+	updater.SetUpdate("odd", 3)
+	updater.ListUpdate("recent", 3, 0)
+	updater.IdsUpdate("3r", 3)
+	Expect(updater.Commit()).Not.To.Equal(nil)
+
+	Expect(db.GetSet("odd").Len()).To.Equal(1)
+	Expect(db.GetList("recent").Len()).To.Equal(0)
+	_, exists := db.GetMapping("3r")
+	Expect(exists).To.Equal(false)
+	Expect(db.Update().Assign("3r")).To.Equal(Id(1), nil)
+
+	db, _ = New(Configure().Storage(storage))
+	Expect(db.GetSet("odd").Len()).To.Equal(1)
+	Expect(db.GetList("recent").Len()).To.Equal(0)
+}
+
+type failingStorage struct {
+	*MemoryStorage
+}
+
+func (s *failingStorage) Begin() (Batch, error) {
+	batch, _ := s.MemoryStorage.Begin()
+	return &failingBatch{batch}, nil
+}
+
+type failingBatch struct {
+	Batch
+}
+
+func (b *failingBatch) Commit() error {
+	b.Batch.Rollback()
+	return errors.New("commit failed")
+}
+
+// false if f doesn't return in time, say because it deadlocked
+func within(f func()) bool {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(5 * time.Second):
+		return false
+	}
 }